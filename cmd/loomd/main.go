@@ -4,17 +4,23 @@ import (
 "context"
 "errors"
 "log"
+"log/slog"
 "net/http"
 "os"
 "os/signal"
+"sort"
 "syscall"
+"time"
 
 "github.com/BurntRouter/Loom/internal/admin"
+"github.com/BurntRouter/Loom/internal/audit"
 "github.com/BurntRouter/Loom/internal/auth"
 "github.com/BurntRouter/Loom/internal/config"
+"github.com/BurntRouter/Loom/internal/logging"
 "github.com/BurntRouter/Loom/internal/metrics"
 "github.com/BurntRouter/Loom/internal/router"
 "github.com/BurntRouter/Loom/internal/tlsutil"
+"github.com/BurntRouter/Loom/internal/tracing"
 "github.com/quic-go/quic-go/http3"
 )
 
@@ -33,13 +39,14 @@ cfg, err := config.Load(cfgPath)
 if err != nil {
 log.Fatal(err)
 }
+if err := logging.Setup(os.Stderr, cfg.Logging); err != nil {
+log.Fatal(err)
+}
 
 runServe(cfg, cfgPath)
 }
 
 func runServe(cfg config.Config, cfgPath string) {
-metrics.Register()
-
 buildRouterCfg := func(c config.Config) router.Config {
 messageChunkQueue := 1
 if c.Router.MaxChunkBytes > 0 {
@@ -49,6 +56,10 @@ if messageChunkQueue < 1 {
 messageChunkQueue = 1
 }
 }
+nodeID := c.Server.NodeID
+if nodeID == "" {
+nodeID, _ = os.Hostname()
+}
 return router.Config{
 PartitionCount:        c.Router.PartitionCount,
 MaxNameBytes:          c.Router.MaxNameBytes,
@@ -61,11 +72,60 @@ ConsumerQueueDepth:    c.Router.ConsumerQueueDepth,
 MessageChunkQueue:     messageChunkQueue,
 PartitionFullBehavior: string(c.Router.PartitionFullBehavior),
 ChunkFullBehavior:     string(c.Router.ChunkFullBehavior),
+DeliveryMode:          string(c.Router.DeliveryMode),
+PingInterval:          c.Router.PingInterval,
+IdleTimeout:           c.Router.IdleTimeout,
+DatagramMaxBytes:      c.Router.DatagramMaxBytes,
+NodeID:                nodeID,
+UploadDir:             c.Uploads.Dir,
+UploadTTL:             c.Uploads.TTL,
+}
+}
+
+buildOverrides := func(c config.Config) []router.RoomOverride {
+var out []router.RoomOverride
+for _, o := range c.Rooms.Overrides {
+out = append(out, router.RoomOverride{
+Match:                 o.Match,
+PartitionCount:        o.PartitionCount,
+MaxMessageBytes:       o.MaxMessageB,
+ConsumerQueueDepth:    o.ConsumerQueueDepth,
+PartitionFullBehavior: string(o.PartitionFullBehavior),
+ChunkFullBehavior:     string(o.ChunkFullBehavior),
+DeliveryMode:          string(o.DeliveryMode),
+DatagramMaxBytes:      o.DatagramMaxBytes,
+Retention:             o.Retention,
+})
+}
+return out
+}
+
+buildRoomPolicy := func(c config.Config) router.RoomPolicy {
+return router.RoomPolicy{
+IdleTTL:         c.Rooms.IdleTTL,
+MaxRooms:        c.Rooms.MaxRooms,
+AllowAutoCreate: c.Rooms.AllowAutoCreate,
+Static:          c.Rooms.Static,
 }
 }
 
 rCfg := buildRouterCfg(cfg)
 rooms := router.NewRoomManager(rCfg)
+rooms.UpdateConfig(rCfg, buildOverrides(cfg)...)
+rooms.SetPolicy(buildRoomPolicy(cfg))
+
+if cfg.Metrics.MaxConsumerSeries > 0 {
+metrics.Register(rooms.ConsumerCollector(cfg.Metrics.MaxConsumerSeries))
+} else {
+metrics.Register()
+}
+
+auditLog, err := audit.New(cfg.Audit)
+if err != nil {
+logging.Fatal("startup failed", logging.KeyErr, err)
+}
+audit.SetDefault(auditLog)
+defer auditLog.Close()
 
 authz := auth.FromConfig(cfg.Auth)
 authCtx := &router.AuthContext{Mode: cfg.Auth.Mode, Authorizer: authz}
@@ -73,14 +133,77 @@ authCtx := &router.AuthContext{Mode: cfg.Auth.Mode, Authorizer: authz}
 ctx, cancel := context.WithCancel(context.Background())
 defer cancel()
 
-adminSrv := admin.New(admin.Config{Addr: cfg.Admin.Addr, EnablePprof: cfg.Admin.EnablePprof})
+shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+if err != nil {
+logging.Fatal("startup failed", logging.KeyErr, err)
+}
+defer func() {
+// Flush buffered spans with a fresh context; ctx is already canceled.
+sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer scancel()
+if err := shutdownTracing(sctx); err != nil {
+slog.Warn("tracing shutdown failed", logging.KeyErr, err)
+}
+}()
+
+go rooms.Run(ctx)
+
+nextProtos := []string{tlsutil.ALPN}
+if cfg.Transport == config.TransportH3 {
+nextProtos = []string{http3.NextProtoH3}
+}
+serverTLS, err := serverTLSConfig(cfg.Server.TLS, nextProtos)
+if err != nil {
+logging.Fatal("startup failed", logging.KeyErr, err)
+}
+
+var srv interface {
+ListenAndServe(ctx context.Context) error
+Listening() error
+}
+switch cfg.Transport {
+case config.TransportH3:
+srv = &router.H3Server{Addr: cfg.Server.Addr, TLS: serverTLS, Rooms: rooms, Auth: authCtx}
+default:
+srv = &router.Server{Addr: cfg.Server.Addr, TLS: serverTLS, Rooms: rooms, Auth: authCtx}
+}
+
+listenerCheck := admin.Check{Name: "listener", Run: srv.Listening}
+readyChecks := []admin.Check{
+listenerCheck,
+{Name: "tls_cert", Run: func() error { return tlsutil.CheckCertificates(serverTLS, time.Now()) }},
+{Name: "draining", Run: func() error {
+if rooms.Draining() {
+return router.ErrDraining
+}
+return nil
+}},
+}
+minRooms := make([]string, 0, len(cfg.Admin.Readiness.MinConsumers))
+for room := range cfg.Admin.Readiness.MinConsumers {
+minRooms = append(minRooms, room)
+}
+sort.Strings(minRooms)
+for _, room := range minRooms {
+readyChecks = append(readyChecks, admin.MinConsumers(rooms, room, cfg.Admin.Readiness.MinConsumers[room]))
+}
+
+adminSrv := admin.New(admin.Config{
+Addr:        cfg.Admin.Addr,
+EnablePprof: cfg.Admin.EnablePprof,
+Rooms:       rooms,
+Live:        []admin.Check{listenerCheck},
+Ready:       readyChecks,
+Token:       cfg.Admin.Token,
+})
 go func() {
 if err := adminSrv.ListenAndServe(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
-log.Printf("admin server error: %v", err)
+slog.Error("admin server error", logging.KeyErr, err)
 cancel()
 }
 }()
 
+drainTimeout := cfg.Shutdown.DrainTimeout
 sigCh := make(chan os.Signal, 2)
 signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 go func() {
@@ -89,39 +212,40 @@ switch sig {
 case syscall.SIGHUP:
 next, err := config.Load(cfgPath)
 if err != nil {
-log.Printf("reload failed: %v", err)
+slog.Error("reload failed", logging.KeyErr, err)
 continue
 }
-rooms.UpdateConfig(buildRouterCfg(next))
+rooms.UpdateConfig(buildRouterCfg(next), buildOverrides(next)...)
+rooms.SetPolicy(buildRoomPolicy(next))
 authCtx.Mode = next.Auth.Mode
 authCtx.Authorizer = auth.FromConfig(next.Auth)
-log.Printf("reloaded config: %s", cfgPath)
+drainTimeout = next.Shutdown.DrainTimeout
+if err := logging.SetLevel(next.Logging.Level); err != nil {
+slog.Error("reload failed", logging.KeyErr, err)
+}
+slog.Info("reloaded config", "path", cfgPath)
 default:
+if rooms.Draining() || drainTimeout == 0 {
 cancel()
 return
 }
+// Stop taking streams and let in-flight messages finish; a second
+// signal or the timeout closes everything.
+slog.Info("draining", "timeout", drainTimeout)
+rooms.Drain(drainTimeout)
+go func(timeout time.Duration) {
+dctx, dcancel := context.WithTimeout(ctx, timeout)
+defer dcancel()
+if !rooms.WaitDrained(dctx) {
+slog.Warn("drain timeout reached, closing remaining streams")
 }
-}()
-
-nextProtos := []string{tlsutil.ALPN}
-if cfg.Transport == config.TransportH3 {
-nextProtos = []string{http3.NextProtoH3}
+cancel()
+}(drainTimeout)
 }
-serverTLS, err := serverTLSConfig(cfg.Server.TLS, nextProtos)
-if err != nil {
-log.Fatal(err)
 }
+}()
 
-switch cfg.Transport {
-case config.TransportH3:
-s := &router.H3Server{Addr: cfg.Server.Addr, TLS: serverTLS, Rooms: rooms, Auth: authCtx}
-if err := s.ListenAndServe(ctx); err != nil {
-log.Fatal(err)
-}
-default:
-s := &router.Server{Addr: cfg.Server.Addr, TLS: serverTLS, Rooms: rooms, Auth: authCtx}
-if err := s.ListenAndServe(ctx); err != nil && !errors.Is(err, context.Canceled) {
-log.Fatal(err)
-}
+if err := srv.ListenAndServe(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, http.ErrServerClosed) {
+logging.Fatal("server failed", logging.KeyErr, err)
 }
 }
@@ -7,12 +7,23 @@ import (
 	"net/http/pprof"
 	"time"
 
+	"github.com/BurntRouter/Loom/internal/router"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Config struct {
 	Addr        string
 	EnablePprof bool
+
+	// Rooms enables the /api JSON endpoints when set.
+	Rooms *router.RoomManager
+	// Live and Ready are the checks behind /healthz and /readyz. Either
+	// endpoint returns 503 if one of its checks fails.
+	Live  []Check
+	Ready []Check
+	// Token is the bearer token for /api. Without it the API is read-only
+	// and unauthenticated.
+	Token string
 }
 
 type Server struct {
@@ -23,8 +34,12 @@ type Server struct {
 func New(cfg Config) *Server {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	mux.HandleFunc("/healthz", healthHandler(cfg.Live))
+	mux.HandleFunc("/readyz", healthHandler(cfg.Ready))
+
+	if cfg.Rooms != nil {
+		registerAPI(mux, cfg.Rooms, cfg.Token)
+	}
 
 	if cfg.EnablePprof {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/BurntRouter/Loom/internal/router"
+)
+
+func TestRoomsAPI(t *testing.T) {
+	cfg := router.DefaultConfig()
+	cfg.PartitionCount = 4
+	rooms := router.NewRoomManager(cfg)
+	if _, err := rooms.Get("builds.linux"); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Rooms: rooms}).srv.Handler
+
+	get := func(path string, want int, v any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Fatalf("GET %s: status %d, want %d: %s", path, rec.Code, want, rec.Body)
+		}
+		if v != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		}
+	}
+
+	var list []router.RoomSummary
+	get("/api/rooms", http.StatusOK, &list)
+	if len(list) != 1 || list[0].Name != "builds.linux" {
+		t.Fatalf("unexpected rooms: %+v", list)
+	}
+
+	var snap router.RoomSnapshot
+	get("/api/rooms/builds.linux", http.StatusOK, &snap)
+	if snap.PartitionCount != 4 || len(snap.Consumers) != 0 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+
+	var parts []router.PartitionAssignment
+	get("/api/rooms/builds.linux/partitions", http.StatusOK, &parts)
+	if len(parts) != 4 || parts[3].Partition != 3 || parts[3].ConsumerID != "" {
+		t.Fatalf("unexpected partitions: %+v", parts)
+	}
+
+	// Unknown rooms are not created by lookups.
+	get("/api/rooms/nope", http.StatusNotFound, nil)
+	if len(rooms.Rooms()) != 1 {
+		t.Fatal("lookup created a room")
+	}
+}
+
+func TestAdminOperationsRequireToken(t *testing.T) {
+	rooms := router.NewRoomManager(router.DefaultConfig())
+	if _, err := rooms.Get("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(h http.Handler, method, path, token string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	open := New(Config{Rooms: rooms}).srv.Handler
+	if code := do(open, http.MethodPost, "/api/rooms/orders/pause", ""); code != http.StatusForbidden {
+		t.Fatalf("pause without admin token configured: status %d", code)
+	}
+
+	h := New(Config{Rooms: rooms, Token: "s3cret"}).srv.Handler
+	if code := do(h, http.MethodGet, "/api/rooms", ""); code != http.StatusUnauthorized {
+		t.Fatalf("read without token: status %d", code)
+	}
+	if code := do(h, http.MethodPost, "/api/rooms/orders/pause", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("pause with bad token: status %d", code)
+	}
+	if code := do(h, http.MethodPost, "/api/rooms/orders/pause?mode=reject", "s3cret"); code != http.StatusOK {
+		t.Fatalf("pause: status %d", code)
+	}
+	r, _ := rooms.Lookup("orders")
+	if r.PauseMode() != router.PauseReject {
+		t.Fatalf("pause mode %q", r.PauseMode())
+	}
+	if code := do(h, http.MethodPost, "/api/rooms/orders/resume", "s3cret"); code != http.StatusOK {
+		t.Fatalf("resume: status %d", code)
+	}
+	if code := do(h, http.MethodPost, "/api/rooms/orders/resume", "s3cret"); code != http.StatusConflict {
+		t.Fatalf("second resume: status %d", code)
+	}
+	if code := do(h, http.MethodPost, "/api/rooms/orders/consumers/c-9/kick", "s3cret"); code != http.StatusNotFound {
+		t.Fatalf("kick unknown consumer: status %d", code)
+	}
+	if code := do(h, http.MethodDelete, "/api/blocked-producers/orders:p:1.2.3.4:5", "s3cret"); code != http.StatusNotFound {
+		t.Fatalf("unblock unknown producer: status %d", code)
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	rooms := router.NewRoomManager(router.DefaultConfig())
+	listening := errors.New("router: listener not bound")
+	h := New(Config{
+		Rooms: rooms,
+		Live:  []Check{{Name: "listener", Run: func() error { return listening }}},
+		Ready: []Check{MinConsumers(rooms, "orders", 1)},
+	}).srv.Handler
+
+	check := func(path string, want int) healthBody {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Fatalf("GET %s: status %d, want %d: %s", path, rec.Code, want, rec.Body)
+		}
+		var body healthBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	body := check("/healthz", http.StatusServiceUnavailable)
+	if body.Status != statusFail || len(body.Checks) != 1 || body.Checks[0].Error == "" {
+		t.Fatalf("unexpected health body: %+v", body)
+	}
+	listening = nil
+	check("/healthz", http.StatusOK)
+
+	body = check("/readyz", http.StatusServiceUnavailable)
+	if body.Checks[0].Name != "min_consumers:orders" || body.Checks[0].Status != statusFail {
+		t.Fatalf("unexpected readiness body: %+v", body)
+	}
+}
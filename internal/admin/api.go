@@ -0,0 +1,178 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/BurntRouter/Loom/internal/audit"
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/router"
+)
+
+// registerAPI mounts the JSON API over the room manager. When token is set
+// every endpoint requires it; the mutating endpoints are only mounted then.
+func registerAPI(mux *http.ServeMux, rooms *router.RoomManager, token string) {
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, requireToken(token, h))
+	}
+
+	handle("GET /api/rooms", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, rooms.Rooms())
+	})
+	handle("GET /api/rooms/{room}", withRoom(rooms, func(w http.ResponseWriter, _ *http.Request, r *router.Router) {
+		writeJSON(w, http.StatusOK, r.Snapshot())
+	}))
+	handle("GET /api/rooms/{room}/consumers", withRoom(rooms, func(w http.ResponseWriter, _ *http.Request, r *router.Router) {
+		writeJSON(w, http.StatusOK, r.Consumers())
+	}))
+	handle("GET /api/rooms/{room}/producers", withRoom(rooms, func(w http.ResponseWriter, _ *http.Request, r *router.Router) {
+		writeJSON(w, http.StatusOK, r.Producers())
+	}))
+	handle("GET /api/rooms/{room}/partitions", withRoom(rooms, func(w http.ResponseWriter, _ *http.Request, r *router.Router) {
+		writeJSON(w, http.StatusOK, r.Partitions())
+	}))
+	handle("GET /api/blocked-producers", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, rooms.BlockedProducers())
+	})
+
+	if token == "" {
+		mux.Handle("POST /api/", http.HandlerFunc(forbidden))
+		mux.Handle("DELETE /api/", http.HandlerFunc(forbidden))
+		return
+	}
+
+	handle("POST /api/rooms/{room}/pause", withRoom(rooms, func(w http.ResponseWriter, req *http.Request, r *router.Router) {
+		mode := req.URL.Query().Get("mode")
+		if mode == "" {
+			mode = router.PauseBlock
+		}
+		if err := r.Pause(mode); err != nil {
+			recordAction(req, "pause", req.PathValue("room"), mode, false)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		recordAction(req, "pause", req.PathValue("room"), mode, true)
+		writeJSON(w, http.StatusOK, r.Snapshot())
+	}))
+	handle("POST /api/rooms/{room}/resume", withRoom(rooms, func(w http.ResponseWriter, req *http.Request, r *router.Router) {
+		ok := r.Resume()
+		recordAction(req, "resume", req.PathValue("room"), "", ok)
+		if !ok {
+			writeError(w, http.StatusConflict, "room is not paused")
+			return
+		}
+		writeJSON(w, http.StatusOK, r.Snapshot())
+	}))
+	handle("POST /api/rooms/{room}/consumers/{id}/kick", withRoom(rooms, func(w http.ResponseWriter, req *http.Request, r *router.Router) {
+		id := req.PathValue("id")
+		ok := r.KickConsumer(id)
+		recordAction(req, "kick", req.PathValue("room"), id, ok)
+		if !ok {
+			writeError(w, http.StatusNotFound, "consumer not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	handle("POST /api/rooms/{room}/consumers/{id}/purge", withRoom(rooms, func(w http.ResponseWriter, req *http.Request, r *router.Router) {
+		id := req.PathValue("id")
+		n, ok := r.PurgeConsumer(id)
+		recordAction(req, "purge", req.PathValue("room"), id, ok)
+		if !ok {
+			writeError(w, http.StatusNotFound, "consumer not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, purgeResult{Purged: n})
+	}))
+	handle("DELETE /api/blocked-producers/{key...}", func(w http.ResponseWriter, req *http.Request) {
+		key := req.PathValue("key")
+		ok := rooms.UnblockProducer(key)
+		recordAction(req, "unblock", "", key, ok)
+		if !ok {
+			writeError(w, http.StatusNotFound, "producer not blocked")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// requireToken rejects requests without the bearer token. An empty token
+// lets every request through.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			if req.Method != http.MethodGet {
+				audit.Record(audit.Event{
+					Kind:       audit.KindAdmin,
+					Result:     audit.ResultDeny,
+					Reason:     "unauthorized",
+					Action:     req.Method + " " + req.URL.Path,
+					RemoteAddr: req.RemoteAddr,
+				})
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="loom"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func forbidden(w http.ResponseWriter, _ *http.Request) {
+	writeError(w, http.StatusForbidden, "admin.token is not configured")
+}
+
+// recordAction logs an operator action and writes it to the audit log.
+func recordAction(req *http.Request, action, room, target string, ok bool) {
+	slog.Info("loom: admin action", "action", action, logging.KeyRoom, room, "target", target, logging.KeyRemoteAddr, req.RemoteAddr, "ok", ok)
+	result := audit.ResultOK
+	if !ok {
+		result = audit.ResultFail
+	}
+	audit.Record(audit.Event{
+		Kind:       audit.KindAdmin,
+		Result:     result,
+		Action:     action,
+		Room:       room,
+		Target:     target,
+		RemoteAddr: req.RemoteAddr,
+	})
+}
+
+// withRoom resolves the {room} path value without creating the room.
+func withRoom(rooms *router.RoomManager, h func(http.ResponseWriter, *http.Request, *router.Router)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r, ok := rooms.Lookup(req.PathValue("room"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "room not found")
+			return
+		}
+		h(w, req, r)
+	}
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorBody{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
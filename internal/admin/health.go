@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/BurntRouter/Loom/internal/router"
+)
+
+// Check is a named health condition. Run returns nil when it passes.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthBody struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// healthHandler runs every check on each request and responds 200 when all
+// pass, 503 otherwise, with a JSON body listing each check.
+func healthHandler(checks []Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		body := healthBody{Status: statusOK, Checks: make([]checkResult, 0, len(checks))}
+		for _, c := range checks {
+			res := checkResult{Name: c.Name, Status: statusOK}
+			if err := c.Run(); err != nil {
+				res.Status = statusFail
+				res.Error = err.Error()
+				body.Status = statusFail
+			}
+			body.Checks = append(body.Checks, res)
+		}
+		status := http.StatusOK
+		if body.Status != statusOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, body)
+	}
+}
+
+// MinConsumers fails while room has fewer than n consumers connected.
+func MinConsumers(rooms *router.RoomManager, room string, n int) Check {
+	return Check{
+		Name: "min_consumers:" + room,
+		Run: func() error {
+			have := 0
+			if r, ok := rooms.Lookup(room); ok {
+				have = r.ConsumerCount()
+			}
+			if have < n {
+				return fmt.Errorf("%d of %d consumers connected", have, n)
+			}
+			return nil
+		},
+	}
+}
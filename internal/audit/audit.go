@@ -0,0 +1,125 @@
+// Package audit writes an append-only record of authentication decisions and
+// admin actions, one JSON object per line.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/config"
+)
+
+// Event kinds.
+const (
+	KindAuth  = "auth"
+	KindAdmin = "admin"
+)
+
+// Event results. Auth decisions are allow or deny; admin actions are ok,
+// fail, or deny when the admin token was missing or wrong.
+const (
+	ResultAllow = "allow"
+	ResultDeny  = "deny"
+	ResultOK    = "ok"
+	ResultFail  = "fail"
+)
+
+// Event is one audit record.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Result     string    `json:"result"`
+	Reason     string    `json:"reason,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	Room       string    `json:"room,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Transport  string    `json:"transport,omitempty"`
+	Action     string    `json:"action,omitempty"`
+	Target     string    `json:"target,omitempty"`
+}
+
+// Logger writes events to every configured sink. A nil Logger discards
+// events.
+type Logger struct {
+	mu    sync.Mutex
+	sinks []io.WriteCloser
+}
+
+// New opens the sinks described by cfg. With auditing disabled it returns a
+// nil Logger.
+func New(cfg config.AuditConfig) (*Logger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	l := &Logger{}
+	if cfg.File != "" {
+		f, err := openRotatingFile(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, f)
+	}
+	if cfg.Syslog.Enabled {
+		w, err := dialSyslog(cfg.Syslog)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		l.sinks = append(l.sinks, w)
+	}
+	return l, nil
+}
+
+// Record writes e, stamping the time if unset. Sink errors are logged and
+// otherwise ignored so auditing never blocks a connection.
+func (l *Logger) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.sinks {
+		if _, err := s.Write(line); err != nil {
+			slog.Warn("loom: audit write failed", "err", err)
+		}
+	}
+}
+
+// Close closes every sink.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var first error
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	l.sinks = nil
+	return first
+}
+
+var std atomic.Pointer[Logger]
+
+// SetDefault makes l the logger used by the package-level Record.
+func SetDefault(l *Logger) { std.Store(l) }
+
+// Record writes e to the default logger, if any.
+func Record(e Event) { std.Load().Record(e) }
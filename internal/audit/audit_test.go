@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntRouter/Loom/internal/config"
+)
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New(config.AuditConfig{Enabled: true, File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(Event{Kind: KindAuth, Result: ResultDeny, Reason: "room not allowed", Principal: "alice", Room: "orders", Role: "produce"})
+	l.Record(Event{Kind: KindAdmin, Result: ResultOK, Action: "kick", Room: "orders", Target: "c1"})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []Event
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2", len(got))
+	}
+	if got[0].Principal != "alice" || got[0].Reason != "room not allowed" || got[0].Time.IsZero() {
+		t.Fatalf("auth event = %+v", got[0])
+	}
+	if got[1].Action != "kick" || got[1].Target != "c1" {
+		t.Fatalf("admin event = %+v", got[1])
+	}
+}
+
+func TestRotatingFileKeepsBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		path:                "dddddddd\n",
+		backupName(path, 1): "cccccccc\n",
+		backupName(path, 2): "bbbbbbbb\n",
+	}
+	for p, content := range want {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Fatalf("%s = %q, want %q", filepath.Base(p), b, content)
+		}
+	}
+	if _, err := os.Stat(backupName(path, 3)); !os.IsNotExist(err) {
+		t.Fatalf("backup 3 exists: %v", err)
+	}
+}
+
+func TestNilLoggerDiscards(t *testing.T) {
+	l, err := New(config.AuditConfig{})
+	if err != nil || l != nil {
+		t.Fatalf("New(disabled) = %v, %v", l, err)
+	}
+	l.Record(Event{Kind: KindAuth})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+
+	"github.com/BurntRouter/Loom/internal/config"
+)
+
+// dialSyslog connects to the syslog daemon described by cfg. An empty
+// network and address use the local daemon.
+func dialSyslog(cfg config.AuditSyslogConfig) (io.WriteCloser, error) {
+	w, err := syslog.Dial(cfg.Network, cfg.Addr, syslog.LOG_INFO|syslog.LOG_AUTH, cfg.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("audit: syslog: %w", err)
+	}
+	return w, nil
+}
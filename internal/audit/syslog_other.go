@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"errors"
+	"io"
+
+	"github.com/BurntRouter/Loom/internal/config"
+)
+
+func dialSyslog(config.AuditSyslogConfig) (io.WriteCloser, error) {
+	return nil, errors.New("audit: syslog is not supported on this platform")
+}
@@ -3,6 +3,8 @@ package auth
 import (
 	"crypto/x509"
 	"errors"
+
+	"github.com/BurntRouter/Loom/internal/subject"
 )
 
 type Role string
@@ -88,12 +90,15 @@ func (a *Authorizer) AuthorizePeerCert(cert *x509.Certificate, room string, role
 	return Decision{Allowed: true, Principal: principal}
 }
 
+// roomAllowed reports whether any rule room covers room. "*" allows every
+// room; dotted patterns such as "builds.>" allow the rooms and subscription
+// patterns they match.
 func roomAllowed(room string, rooms []string) bool {
 	if len(rooms) == 0 {
 		return false
 	}
 	for _, r := range rooms {
-		if r == "*" || r == room {
+		if r == "*" || subject.Match(r, room) {
 			return true
 		}
 	}
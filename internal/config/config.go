@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/BurntRouter/Loom/internal/subject"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,6 +17,10 @@ type PartitionFullBehavior string
 
 type ChunkFullBehavior string
 
+type DeliveryMode string
+
+type LogFormat string
+
 const (
 	TransportQUIC Transport = "quic"
 	TransportH3   Transport = "h3"
@@ -25,6 +32,14 @@ const (
 	// ChunkFullDrop drops the whole message when the per-message chunk queue is full.
 	ChunkFullDrop  ChunkFullBehavior = "drop"
 	ChunkFullBlock ChunkFullBehavior = "block"
+
+	// DeliveryAck makes producers wait for the consumer ACK of each message.
+	DeliveryAck DeliveryMode = "ack"
+	// DeliveryFireAndForget lets producers continue once a message is queued.
+	DeliveryFireAndForget DeliveryMode = "fire_and_forget"
+
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
 )
 
 type Config struct {
@@ -34,11 +49,22 @@ type Config struct {
 	Admin  AdminConfig  `yaml:"admin"`
 	Auth   AuthConfig   `yaml:"auth"`
 	Router RouterConfig `yaml:"router"`
+	Rooms  RoomsConfig  `yaml:"rooms"`
+
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Audit    AuditConfig    `yaml:"audit"`
+	Uploads  UploadsConfig  `yaml:"uploads"`
 }
 
 type ServerConfig struct {
 	Addr string    `yaml:"addr"`
 	TLS  TLSConfig `yaml:"tls"`
+	// NodeID identifies this server to clients in the server Hello.
+	// Empty uses the hostname.
+	NodeID string `yaml:"node_id"`
 }
 
 type RouterConfig struct {
@@ -56,8 +82,136 @@ type RouterConfig struct {
 
 	PartitionFullBehavior PartitionFullBehavior `yaml:"partition_full_behavior"`
 	ChunkFullBehavior     ChunkFullBehavior     `yaml:"chunk_full_behavior"`
+	DeliveryMode          DeliveryMode          `yaml:"delivery_mode"`
+
+	// PingInterval is how often the server PINGs streams that negotiated
+	// pings. Zero disables pings.
+	PingInterval time.Duration `yaml:"ping_interval"`
+	// IdleTimeout closes a pinged stream after this long without hearing
+	// from the client while the server is waiting on it. Zero disables it;
+	// it requires PingInterval.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// DatagramMaxBytes lets QUIC clients send and receive messages with
+	// payloads up to this size as datagrams, best effort. Zero disables it.
+	DatagramMaxBytes int `yaml:"datagram_max_bytes"`
+}
+
+type RoomsConfig struct {
+	// IdleTTL is how long a room with no consumers or producers is kept
+	// before it is deleted. Zero keeps idle rooms forever.
+	IdleTTL time.Duration `yaml:"idle_ttl"`
+	// MaxRooms caps the number of rooms (including wildcard subscriptions).
+	// Zero means unlimited.
+	MaxRooms int `yaml:"max_rooms"`
+	// AllowAutoCreate lets clients create rooms by naming them. When false,
+	// only rooms matching an entry in Static can be used.
+	AllowAutoCreate bool `yaml:"allow_auto_create"`
+	// Static rooms always exist and are never reaped. Entries may be
+	// patterns, which admit any matching room when auto-create is off.
+	Static []string `yaml:"static"`
+	// Overrides adjust router settings for matching rooms. The first entry
+	// whose Match covers a room applies.
+	Overrides []RoomOverride `yaml:"overrides"`
+}
+
+type ShutdownConfig struct {
+	// DrainTimeout bounds how long SIGTERM waits for in-flight messages to
+	// be delivered and ACKed before closing every stream. Zero skips the
+	// drain phase.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+type MetricsConfig struct {
+	// MaxConsumerSeries caps how many consumers get their own per-consumer
+	// series; the rest are aggregated per room. Zero disables per-consumer
+	// metrics.
+	MaxConsumerSeries int `yaml:"max_consumer_series"`
+}
+
+// TracingConfig configures OpenTelemetry tracing with an OTLP/HTTP exporter.
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the collector's host:port.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over plain HTTP instead of HTTPS.
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers"`
+	// SampleRatio is the fraction of new traces sampled; messages that
+	// carry a sampled traceparent are always traced.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+type LoggingConfig struct {
+	// Level is debug, info, warn or error. It is re-read on SIGHUP.
+	Level  string    `yaml:"level"`
+	Format LogFormat `yaml:"format"`
+	// Sampling limits repeats of the same debug/info message.
+	Sampling LogSamplingConfig `yaml:"sampling"`
+}
+
+// LogSamplingConfig keeps the first Initial records of each message per
+// Interval, then every Thereafter-th. Initial 0 disables sampling.
+type LogSamplingConfig struct {
+	Initial    int           `yaml:"initial"`
+	Thereafter int           `yaml:"thereafter"`
+	Interval   time.Duration `yaml:"interval"`
+}
+
+// AuditConfig configures the audit log of auth decisions and admin actions.
+type AuditConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// File receives one JSON event per line. Empty disables the file sink.
+	File string `yaml:"file"`
+	// MaxSizeMB rotates the file once it would grow past this size. Zero
+	// never rotates.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxBackups is how many rotated files are kept.
+	MaxBackups int               `yaml:"max_backups"`
+	Syslog     AuditSyslogConfig `yaml:"syslog"`
+}
+
+// UploadsConfig configures the staging area for resumable producer uploads.
+type UploadsConfig struct {
+	// Dir holds partially received uploads. Empty disables resumable
+	// uploads.
+	Dir string `yaml:"dir"`
+	// TTL is how long a staged upload is kept after its last write. Zero
+	// keeps them until they complete.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// AuditSyslogConfig sends audit events to syslog. Empty Network and Addr use
+// the local daemon.
+type AuditSyslogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Network string `yaml:"network"`
+	Addr    string `yaml:"addr"`
+	Tag     string `yaml:"tag"`
+}
+
+// RoomOverride replaces router settings for rooms matching Match, a room name
+// or pattern. Zero values inherit the router section.
+type RoomOverride struct {
+	Match string `yaml:"match"`
+
+	PartitionCount        int                   `yaml:"partition_count"`
+	MaxMessageB           uint64                `yaml:"max_message_bytes"`
+	ConsumerQueueDepth    int                   `yaml:"max_backlog_depth"`
+	PartitionFullBehavior PartitionFullBehavior `yaml:"partition_full_behavior"`
+	ChunkFullBehavior     ChunkFullBehavior     `yaml:"chunk_full_behavior"`
+	DeliveryMode          DeliveryMode          `yaml:"delivery_mode"`
+	DatagramMaxBytes      int                   `yaml:"datagram_max_bytes"`
+	// Retention replaces uploads.ttl for messages retained for a consumer
+	// to resume.
+	Retention time.Duration `yaml:"retention"`
 }
 
+// MaxDatagramBytes bounds datagram_max_bytes: a datagram must fit in one
+// QUIC packet along with the message header.
+const MaxDatagramBytes = 1024
+
 func Default() Config {
 	return Config{
 		Transport: TransportQUIC,
@@ -84,7 +238,37 @@ func Default() Config {
 			ConsumerQueueDepth:    128,
 			PartitionFullBehavior: PartitionFullDropNewest,
 			ChunkFullBehavior:     ChunkFullDrop,
+			DeliveryMode:          DeliveryAck,
+			PingInterval:          15 * time.Second,
+			IdleTimeout:           45 * time.Second,
+		},
+		Rooms: RoomsConfig{
+			IdleTTL:         10 * time.Minute,
+			MaxRooms:        10000,
+			AllowAutoCreate: true,
 		},
+		Shutdown: ShutdownConfig{DrainTimeout: 30 * time.Second},
+		Metrics:  MetricsConfig{MaxConsumerSeries: 1000},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: LogFormatText,
+			Sampling: LogSamplingConfig{
+				Initial:    20,
+				Thereafter: 100,
+				Interval:   time.Second,
+			},
+		},
+		Tracing: TracingConfig{
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+			ServiceName: "loomd",
+		},
+		Audit: AuditConfig{
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+			Syslog:     AuditSyslogConfig{Tag: "loomd"},
+		},
+		Uploads: UploadsConfig{TTL: 24 * time.Hour},
 	}
 }
 
@@ -128,16 +312,117 @@ func (c *Config) Validate() error {
 	if c.Router.PartitionCount <= 0 {
 		return errors.New("config: router.partition_count must be > 0")
 	}
+	if c.Router.PingInterval < 0 || c.Router.IdleTimeout < 0 {
+		return errors.New("config: router.ping_interval and router.idle_timeout must be >= 0")
+	}
+	if c.Router.IdleTimeout > 0 && c.Router.PingInterval == 0 {
+		// Unpinged clients would be closed for a silence never asked to break.
+		return errors.New("config: router.idle_timeout requires router.ping_interval")
+	}
+	if c.Router.IdleTimeout > 0 && c.Router.IdleTimeout <= c.Router.PingInterval {
+		return errors.New("config: router.idle_timeout must be longer than router.ping_interval")
+	}
+	if c.Router.DatagramMaxBytes < 0 || c.Router.DatagramMaxBytes > MaxDatagramBytes {
+		return fmt.Errorf("config: router.datagram_max_bytes must be between 0 and %d", MaxDatagramBytes)
+	}
 	// Backward compatibility: "drop" means drop_newest.
 	if c.Router.PartitionFullBehavior == "drop" {
 		c.Router.PartitionFullBehavior = PartitionFullDropNewest
 	}
-	if c.Router.PartitionFullBehavior != PartitionFullDropNewest && c.Router.PartitionFullBehavior != PartitionFullDropOldest && c.Router.PartitionFullBehavior != PartitionFullBlock {
+	if !c.Router.PartitionFullBehavior.valid() {
 		return fmt.Errorf("config: unknown router.partition_full_behavior %q", c.Router.PartitionFullBehavior)
 	}
-	if c.Router.ChunkFullBehavior != ChunkFullDrop && c.Router.ChunkFullBehavior != ChunkFullBlock {
+	if !c.Router.ChunkFullBehavior.valid() {
 		return fmt.Errorf("config: unknown router.chunk_full_behavior %q", c.Router.ChunkFullBehavior)
 	}
+	if !c.Router.DeliveryMode.valid() {
+		return fmt.Errorf("config: unknown router.delivery_mode %q", c.Router.DeliveryMode)
+	}
+
+	if c.Rooms.IdleTTL < 0 {
+		return errors.New("config: rooms.idle_ttl must be >= 0")
+	}
+	if c.Rooms.MaxRooms < 0 {
+		return errors.New("config: rooms.max_rooms must be >= 0")
+	}
+	if !c.Rooms.AllowAutoCreate && len(c.Rooms.Static) == 0 {
+		return errors.New("config: rooms.static is required when rooms.allow_auto_create is false")
+	}
+	for _, name := range c.Rooms.Static {
+		if name == "" || !subject.ValidPattern(name) {
+			return fmt.Errorf("config: invalid room %q in rooms.static", name)
+		}
+	}
+	for i := range c.Rooms.Overrides {
+		o := &c.Rooms.Overrides[i]
+		if o.Match == "" || !subject.ValidPattern(o.Match) {
+			return fmt.Errorf("config: invalid rooms.overrides[%d].match %q", i, o.Match)
+		}
+		if o.PartitionCount < 0 || o.ConsumerQueueDepth < 0 {
+			return fmt.Errorf("config: rooms.overrides[%d] (%s): limits must be >= 0", i, o.Match)
+		}
+		if o.Retention < 0 {
+			return fmt.Errorf("config: rooms.overrides[%d] (%s): retention must be >= 0", i, o.Match)
+		}
+		if o.DatagramMaxBytes < 0 || o.DatagramMaxBytes > MaxDatagramBytes {
+			return fmt.Errorf("config: rooms.overrides[%d] (%s): datagram_max_bytes must be between 0 and %d", i, o.Match, MaxDatagramBytes)
+		}
+		if o.PartitionFullBehavior == "drop" {
+			o.PartitionFullBehavior = PartitionFullDropNewest
+		}
+		if o.PartitionFullBehavior != "" && !o.PartitionFullBehavior.valid() {
+			return fmt.Errorf("config: rooms.overrides[%d] (%s): unknown partition_full_behavior %q", i, o.Match, o.PartitionFullBehavior)
+		}
+		if o.ChunkFullBehavior != "" && !o.ChunkFullBehavior.valid() {
+			return fmt.Errorf("config: rooms.overrides[%d] (%s): unknown chunk_full_behavior %q", i, o.Match, o.ChunkFullBehavior)
+		}
+		if o.DeliveryMode != "" && !o.DeliveryMode.valid() {
+			return fmt.Errorf("config: rooms.overrides[%d] (%s): unknown delivery_mode %q", i, o.Match, o.DeliveryMode)
+		}
+	}
+
+	for room, n := range c.Admin.Readiness.MinConsumers {
+		if room == "" || subject.IsPattern(room) || !subject.ValidPattern(room) {
+			return fmt.Errorf("config: invalid room %q in admin.readiness.min_consumers", room)
+		}
+		if n < 0 {
+			return fmt.Errorf("config: admin.readiness.min_consumers[%s] must be >= 0", room)
+		}
+	}
+	if c.Metrics.MaxConsumerSeries < 0 {
+		return errors.New("config: metrics.max_consumer_series must be >= 0")
+	}
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("config: unknown logging.level %q", c.Logging.Level)
+	}
+	if c.Logging.Format != LogFormatText && c.Logging.Format != LogFormatJSON {
+		return fmt.Errorf("config: unknown logging.format %q", c.Logging.Format)
+	}
+	if c.Logging.Sampling.Initial < 0 || c.Logging.Sampling.Thereafter < 0 || c.Logging.Sampling.Interval < 0 {
+		return errors.New("config: logging.sampling values must be >= 0")
+	}
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint == "" {
+			return errors.New("config: tracing.endpoint is required when tracing is enabled")
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			return errors.New("config: tracing.sample_ratio must be between 0 and 1")
+		}
+	}
+	if c.Audit.Enabled && c.Audit.File == "" && !c.Audit.Syslog.Enabled {
+		return errors.New("config: audit.file or audit.syslog is required when audit is enabled")
+	}
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxBackups < 0 {
+		return errors.New("config: audit.max_size_mb and audit.max_backups must be >= 0")
+	}
+	if c.Uploads.TTL < 0 {
+		return errors.New("config: uploads.ttl must be >= 0")
+	}
+	if c.Shutdown.DrainTimeout < 0 {
+		return errors.New("config: shutdown.drain_timeout must be >= 0")
+	}
 
 	if c.Server.Addr == "" {
 		return errors.New("config: server.addr is required")
@@ -157,3 +442,15 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+func (b PartitionFullBehavior) valid() bool {
+	return b == PartitionFullDropNewest || b == PartitionFullDropOldest || b == PartitionFullBlock
+}
+
+func (b ChunkFullBehavior) valid() bool {
+	return b == ChunkFullDrop || b == ChunkFullBlock
+}
+
+func (m DeliveryMode) valid() bool {
+	return m == DeliveryAck || m == DeliveryFireAndForget
+}
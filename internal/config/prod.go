@@ -3,6 +3,20 @@ package config
 type AdminConfig struct {
 	Addr        string `yaml:"addr"`
 	EnablePprof bool   `yaml:"enable_pprof"`
+
+	// Token is the bearer token required by the /api endpoints. Mutating
+	// endpoints are disabled when it is empty.
+	Token string `yaml:"token"`
+
+	Readiness ReadinessConfig `yaml:"readiness"`
+}
+
+// ReadinessConfig adds optional conditions to /readyz on top of the listener
+// and certificate checks.
+type ReadinessConfig struct {
+	// MinConsumers maps a room name to the number of consumers it needs
+	// before the node reports ready.
+	MinConsumers map[string]int `yaml:"min_consumers"`
 }
 
 type TLSConfig struct {
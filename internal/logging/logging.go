@@ -0,0 +1,156 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/config"
+)
+
+// Attribute keys shared by every component so log lines can be joined on them.
+const (
+	KeyRoom       = "room"
+	KeyPrincipal  = "principal"
+	KeyConsumerID = "consumer_id"
+	KeyProducerID = "producer_id"
+	KeyMsgID      = "msg_id"
+	KeyRemoteAddr = "remote_addr"
+	KeyTransport  = "transport"
+	KeyName       = "name"
+	KeyErr        = "err"
+)
+
+// level is shared by the default logger so reloads can change it in place.
+var level slog.LevelVar
+
+// Setup installs the default slog logger described by cfg, writing to w.
+// Calls through the standard log package are routed to it at info level.
+func Setup(w io.Writer, cfg config.LoggingConfig) error {
+	l, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+
+	opts := &slog.HandlerOptions{Level: &level}
+	var h slog.Handler
+	switch cfg.Format {
+	case config.LogFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	case config.LogFormatText, "":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("logging: unknown format %q", cfg.Format)
+	}
+	if cfg.Sampling.Initial > 0 {
+		h = NewSamplingHandler(h, cfg.Sampling.Initial, cfg.Sampling.Thereafter, cfg.Sampling.Interval)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// SetLevel changes the level of the logger installed by Setup.
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// ParseLevel maps debug, info, warn and error to slog levels.
+func ParseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return 0, fmt.Errorf("logging: unknown level %q", name)
+	}
+	return l, nil
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// samplingHandler drops repeats of the same message at the same level: per
+// interval the first `initial` records are kept, then every `thereafter`-th.
+// Warnings and errors are never sampled.
+type samplingHandler struct {
+	slog.Handler
+	s *sampler
+}
+
+type sampler struct {
+	initial    int
+	thereafter int
+	interval   time.Duration
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+type sampleKey struct {
+	level slog.Level
+	msg   string
+}
+
+type sampleCount struct {
+	reset time.Time
+	n     int
+}
+
+// NewSamplingHandler wraps h with per-message sampling. A zero thereafter
+// drops everything past the initial records in each interval.
+func NewSamplingHandler(h slog.Handler, initial, thereafter int, interval time.Duration) slog.Handler {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &samplingHandler{Handler: h, s: &sampler{
+		initial:    initial,
+		thereafter: thereafter,
+		interval:   interval,
+		counts:     make(map[sampleKey]*sampleCount),
+	}}
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn && !h.s.allow(sampleKey{r.Level, r.Message}, r.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), s: h.s}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), s: h.s}
+}
+
+func (s *sampler) allow(k sampleKey, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counts[k]
+	if c == nil || now.After(c.reset) {
+		if len(s.counts) > 10000 {
+			// Messages are constant strings; this only guards against misuse.
+			s.counts = make(map[sampleKey]*sampleCount)
+		}
+		c = &sampleCount{reset: now.Add(s.interval)}
+		s.counts[k] = c
+	}
+	c.n++
+	if c.n <= s.initial {
+		return true
+	}
+	return s.thereafter > 0 && (c.n-s.initial)%s.thereafter == 0
+}
@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSamplingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewSamplingHandler(slog.NewTextHandler(&buf, nil), 2, 3, time.Hour)
+	logger := slog.New(h).With("room", "orders")
+
+	for i := 0; i < 8; i++ {
+		logger.Info("message written")
+	}
+	logger.Warn("consumer write failed")
+	logger.Warn("consumer write failed")
+
+	// 2 initial, then every 3rd of the remaining 6 (the 5th and 8th), plus
+	// both warnings.
+	if n := strings.Count(buf.String(), "message written"); n != 4 {
+		t.Fatalf("logged %d info records, want 4:\n%s", n, buf.String())
+	}
+	if n := strings.Count(buf.String(), "consumer write failed"); n != 2 {
+		t.Fatalf("logged %d warnings, want 2", n)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{"debug": slog.LevelDebug, "info": slog.LevelInfo, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		got, err := ParseLevel(name)
+		if err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+}
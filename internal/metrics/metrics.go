@@ -7,6 +7,9 @@ var (
 		prometheus.GaugeOpts{Name: "loom_connections", Help: "Active connections"},
 		[]string{"transport"},
 	)
+	Rooms = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "loom_rooms", Help: "Rooms currently held in memory"},
+	)
 	Streams = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{Name: "loom_streams", Help: "Active streams"},
 		[]string{"transport", "role", "room"},
@@ -39,8 +42,49 @@ var (
 		prometheus.CounterOpts{Name: "loom_blocked_producers_total", Help: "Producers blocked due to repeated errors"},
 		[]string{"room"},
 	)
+	AuthDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "loom_auth_decisions_total", Help: "Stream authorization decisions"},
+		[]string{"result", "reason"},
+	)
+
+	MessageSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "loom_message_size_bytes",
+			Help:    "Payload size of routed messages",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 10), // 256B .. 64MiB
+		},
+		[]string{"room"},
+	)
+	MessageLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "loom_message_latency_seconds",
+			Help:    "Time from reading a message header from the producer to the consumer ACK",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16), // 1ms .. 32s
+		},
+		[]string{"room"},
+	)
+	QueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "loom_queue_wait_seconds",
+			Help:    "Time a message spends in a consumer backlog before it is written",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16), // 0.5ms .. 16s
+		},
+		[]string{"room"},
+	)
+	ChunkWriteLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "loom_chunk_write_seconds",
+			Help:    "Time to write and flush one chunk to a consumer stream",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14), // 0.1ms .. 0.8s
+		},
+		[]string{"room"},
+	)
 )
 
-func Register() {
-	prometheus.MustRegister(Connections, Streams, MessagesIn, MessagesOut, BytesIn, BytesOut, Drops, ProtocolErrors, BlockedProducers)
+// Register registers Loom's metrics, plus any extra collectors, with the
+// default registry.
+func Register(extra ...prometheus.Collector) {
+	prometheus.MustRegister(Connections, Rooms, Streams, MessagesIn, MessagesOut, BytesIn, BytesOut, Drops, ProtocolErrors, BlockedProducers, AuthDecisions)
+	prometheus.MustRegister(MessageSize, MessageLatency, QueueWait, ChunkWriteLatency)
+	prometheus.MustRegister(extra...)
 }
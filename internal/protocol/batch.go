@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// MaxBatchMessages bounds the messages in one batch.
+const MaxBatchMessages = 1024
+
+// BatchEntry is one message of a batch.
+type BatchEntry struct {
+	Header  MessageHeader
+	Payload []byte
+}
+
+// WriteBatch writes entries as one BATCH control frame and flushes it.
+//
+// Wire format: ControlEscape, FrameBatch (uvarint), count (uvarint), then
+// count × (message header, payload length (uvarint), payload).
+func WriteBatch(w *bufio.Writer, version byte, entries []BatchEntry) error {
+	if len(entries) == 0 || len(entries) > MaxBatchMessages {
+		return fmt.Errorf("protocol: batch of %d messages (max %d)", len(entries), MaxBatchMessages)
+	}
+	if err := w.WriteByte(ControlEscape); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, FrameBatch); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, uint64(len(entries))); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := WriteMessageHeader(w, version, e.Header); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(len(e.Payload))); err != nil {
+			return err
+		}
+		if _, err := w.Write(e.Payload); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// ReadBatch reads the messages of a BATCH frame after ReadControlFrame
+// returned FrameBatch and count. Their payloads may total at most maxBytes.
+func ReadBatch(r *bufio.Reader, version byte, count uint64, maxKeyBytes int, maxBytes uint64) ([]BatchEntry, error) {
+	if count == 0 || count > MaxBatchMessages {
+		return nil, fmt.Errorf("protocol: batch of %d messages (max %d)", count, MaxBatchMessages)
+	}
+	entries := make([]BatchEntry, 0, count)
+	var total uint64
+	for i := uint64(0); i < count; i++ {
+		hdr, err := ReadMessageHeader(r, version, maxKeyBytes)
+		if err != nil {
+			return nil, err
+		}
+		n, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if total += n; n > maxBytes || total > maxBytes {
+			return nil, fmt.Errorf("protocol: batch too large: over %d bytes", maxBytes)
+		}
+		payload := make([]byte, int(n))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		entries = append(entries, BatchEntry{Header: hdr, Payload: payload})
+	}
+	return entries, nil
+}
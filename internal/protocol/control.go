@@ -0,0 +1,46 @@
+package protocol
+
+import "bufio"
+
+// ControlEscape introduces a frame where a message header could otherwise
+// appear: on the server-to-consumer and producer-to-server directions. It
+// is unambiguous because a message header never starts with a zero key
+// length.
+const ControlEscape = byte(0)
+
+// WriteFrame writes a frame_type + value frame and flushes it.
+func WriteFrame(w *bufio.Writer, frameType, value uint64) error {
+	if err := writeUvarint(w, frameType); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, value); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// WriteControlFrame writes a frame preceded by ControlEscape and flushes it.
+func WriteControlFrame(w *bufio.Writer, frameType, value uint64) error {
+	if err := w.WriteByte(ControlEscape); err != nil {
+		return err
+	}
+	return WriteFrame(w, frameType, value)
+}
+
+// IsControlFrame reports whether the next byte on r starts a control frame
+// rather than a message header. It blocks until a byte is available.
+func IsControlFrame(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == ControlEscape, nil
+}
+
+// ReadControlFrame reads a frame written by WriteControlFrame.
+func ReadControlFrame(r *bufio.Reader) (frameType uint64, value uint64, err error) {
+	if _, err := r.ReadByte(); err != nil {
+		return 0, 0, err
+	}
+	return ReadFrame(r)
+}
@@ -0,0 +1,28 @@
+package protocol
+
+import "bufio"
+
+// WriteCredit sets the consumer's delivery window: the server starts a new
+// message only while fewer than messages are awaiting ACK and, if bytes is
+// non-zero, fewer than bytes payload bytes are. A zero message window
+// pauses delivery. The frame is flushed.
+//
+// Wire format: FrameCredit (uvarint), messages (uvarint), bytes (uvarint).
+func WriteCredit(w *bufio.Writer, messages, bytes uint64) error {
+	if err := writeUvarint(w, FrameCredit); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, messages); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, bytes); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ReadCreditBytes reads the byte window of a CREDIT frame after ReadFrame
+// returned FrameCredit and the message window.
+func ReadCreditBytes(r *bufio.Reader) (uint64, error) {
+	return readUvarint(r)
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A datagram (v6, FeatureDatagrams) carries one small message in a QUIC
+// DATAGRAM frame. It belongs to the session of the stream it names: a
+// producer's stream for messages it sends, a consumer's for messages it
+// receives. Datagrams may be lost or reordered and are never ACKed.
+//
+// Wire format: stream id (uvarint), the message header as on that stream,
+// then the payload, up to the end of the datagram.
+
+// AppendDatagram appends a datagram carrying hdr and payload for the
+// session on stream streamID to b.
+func AppendDatagram(b []byte, streamID uint64, version byte, hdr MessageHeader, payload []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	w := bufio.NewWriter(buf)
+	if err := writeUvarint(w, streamID); err != nil {
+		return nil, err
+	}
+	if err := WriteMessageHeader(w, version, hdr); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// DatagramStreamID returns the stream id a datagram names and the rest of
+// the datagram, for ReadDatagramMessage.
+func DatagramStreamID(b []byte) (uint64, []byte, error) {
+	id, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errors.New("protocol: bad datagram stream id")
+	}
+	return id, b[n:], nil
+}
+
+// ReadDatagramMessage reads the message header and payload that follow the
+// stream id of a datagram.
+func ReadDatagramMessage(b []byte, version byte, maxKeyBytes int) (MessageHeader, []byte, error) {
+	r := bytes.NewReader(b)
+	br := bufio.NewReaderSize(r, len(b))
+	hdr, err := ReadMessageHeader(br, version, maxKeyBytes)
+	if err != nil {
+		return MessageHeader{}, nil, err
+	}
+	rest := br.Buffered() + r.Len()
+	return hdr, b[len(b)-rest:], nil
+}
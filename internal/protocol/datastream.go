@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// WriteDataStreamHeader starts a data stream for the consumer consumerID.
+// Exactly one message follows it on the stream, framed as on the consumer
+// stream, and the stream ends with the message. The header is not flushed.
+//
+// Wire format: FrameDataStream (uvarint), consumer id (string).
+func WriteDataStreamHeader(w *bufio.Writer, consumerID string) error {
+	if err := writeUvarint(w, FrameDataStream); err != nil {
+		return err
+	}
+	return writeString(w, consumerID)
+}
+
+// ReadDataStreamHeader reads the header of a data stream and returns the
+// consumer id it delivers to.
+func ReadDataStreamHeader(r *bufio.Reader, maxIDBytes int) (string, error) {
+	ft, err := readUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if ft != FrameDataStream {
+		return "", fmt.Errorf("protocol: unexpected frame %d on data stream", ft)
+	}
+	return readString(r, maxIDBytes, "consumer id")
+}
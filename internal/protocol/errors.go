@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// ErrorCode identifies why the server rejected or ended a stream. It is
+// carried in ERROR frames and used as the QUIC application error code when
+// the stream is reset.
+type ErrorCode uint64
+
+const (
+	ErrorBadHandshake       ErrorCode = 1
+	ErrorUnsupportedVersion ErrorCode = 2
+	ErrorUnauthorized       ErrorCode = 3
+	ErrorForbiddenRoom      ErrorCode = 4
+	ErrorBlocked            ErrorCode = 5
+	ErrorRoomPaused         ErrorCode = 6
+	ErrorRoomClosed         ErrorCode = 7
+)
+
+// maxErrorMessageBytes bounds the message in an ERROR frame.
+const maxErrorMessageBytes = 1024
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorBadHandshake:
+		return "bad_handshake"
+	case ErrorUnsupportedVersion:
+		return "unsupported_version"
+	case ErrorUnauthorized:
+		return "unauthorized"
+	case ErrorForbiddenRoom:
+		return "forbidden_room"
+	case ErrorBlocked:
+		return "blocked"
+	case ErrorRoomPaused:
+		return "room_paused"
+	case ErrorRoomClosed:
+		return "room_closed"
+	default:
+		return fmt.Sprintf("error_%d", uint64(c))
+	}
+}
+
+// Retryable reports whether the same request may succeed later: a paused
+// room resumes, a closed room is recreated and a producer block expires. The
+// other codes need the client or its credentials to change.
+func (c ErrorCode) Retryable() bool {
+	return c == ErrorBlocked || c == ErrorRoomPaused || c == ErrorRoomClosed
+}
+
+// StreamError is an error reported by the server in an ERROR frame.
+type StreamError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == "" {
+		return "protocol: server error " + e.Code.String()
+	}
+	return "protocol: server error " + e.Code.String() + ": " + e.Message
+}
+
+// WriteError writes an ERROR frame. It is the last frame on the stream.
+func WriteError(w *bufio.Writer, code ErrorCode, msg string) error {
+	if len(msg) > maxErrorMessageBytes {
+		msg = msg[:maxErrorMessageBytes]
+	}
+	if err := writeUvarint(w, FrameError); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, uint64(code)); err != nil {
+		return err
+	}
+	if err := writeString(w, msg); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ReadErrorMessage reads the rest of an ERROR frame after ReadFrame returned
+// FrameError and its code.
+func ReadErrorMessage(r *bufio.Reader, code uint64) (*StreamError, error) {
+	msg, err := readString(r, maxErrorMessageBytes, "error message")
+	if err != nil {
+		return nil, err
+	}
+	return &StreamError{Code: ErrorCode(code), Message: msg}, nil
+}
@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Hello extension tags (v5+).
+const (
+	// ExtFilterPartitions restricts a consumer to a set of partitions.
+	// Value: count (uvarint) followed by that many partition numbers (uvarint).
+	ExtFilterPartitions = uint64(1)
+	// ExtFilterKeyPrefix restricts a consumer to keys with a prefix.
+	// Value: the raw prefix bytes.
+	ExtFilterKeyPrefix = uint64(2)
+	// ExtFilterHeader restricts a consumer to messages carrying a header
+	// field with an exact value. May be repeated; all must match.
+	// Value: name (string) followed by value (string).
+	ExtFilterHeader = uint64(3)
+	// ExtFeatures requests optional features (v6+).
+	// Value: the requested Feature* flags (uvarint).
+	ExtFeatures = uint64(4)
+	// ExtDataStreams asks for at most this many data streams at once
+	// (v6+, FeatureStreams). Value: the count (uvarint).
+	ExtDataStreams = uint64(5)
+)
+
+// Filter is a consumer's subscription filter. Empty fields match everything;
+// non-empty fields must all match.
+type Filter struct {
+	Partitions []uint64
+	KeyPrefix  []byte
+	Headers    []HeaderField
+}
+
+// IsZero reports whether the filter matches every message.
+func (f Filter) IsZero() bool {
+	return len(f.Partitions) == 0 && len(f.KeyPrefix) == 0 && len(f.Headers) == 0
+}
+
+type helloExtension struct {
+	tag uint64
+	val []byte
+}
+
+func (h Hello) extensions() []helloExtension {
+	var exts []helloExtension
+	if len(h.Filter.Partitions) > 0 {
+		var b bytes.Buffer
+		_ = writeUvarint(&b, uint64(len(h.Filter.Partitions)))
+		for _, p := range h.Filter.Partitions {
+			_ = writeUvarint(&b, p)
+		}
+		exts = append(exts, helloExtension{ExtFilterPartitions, b.Bytes()})
+	}
+	if len(h.Filter.KeyPrefix) > 0 {
+		exts = append(exts, helloExtension{ExtFilterKeyPrefix, h.Filter.KeyPrefix})
+	}
+	for _, f := range h.Filter.Headers {
+		var b bytes.Buffer
+		bw := bufio.NewWriter(&b)
+		_ = writeString(bw, f.Name)
+		_ = writeString(bw, f.Value)
+		_ = bw.Flush()
+		exts = append(exts, helloExtension{ExtFilterHeader, b.Bytes()})
+	}
+	if h.Features != 0 {
+		exts = append(exts, uvarintExtension(ExtFeatures, h.Features))
+	}
+	if h.DataStreams != 0 {
+		exts = append(exts, uvarintExtension(ExtDataStreams, h.DataStreams))
+	}
+	return exts
+}
+
+func uvarintExtension(tag, v uint64) helloExtension {
+	var b bytes.Buffer
+	_ = writeUvarint(&b, v)
+	return helloExtension{tag, b.Bytes()}
+}
+
+func writeHelloExtensions(w *bufio.Writer, h Hello) error {
+	return writeExtensions(w, h.extensions())
+}
+
+func writeExtensions(w *bufio.Writer, exts []helloExtension) error {
+	if err := writeUvarint(w, uint64(len(exts))); err != nil {
+		return err
+	}
+	for _, e := range exts {
+		if len(e.val) > maxHelloExtBytes {
+			return fmt.Errorf("protocol: hello extension %d too large: %d", e.tag, len(e.val))
+		}
+		if err := writeUvarint(w, e.tag); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(len(e.val))); err != nil {
+			return err
+		}
+		if _, err := w.Write(e.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyExtension decodes a single Hello extension into h. Unknown tags are
+// ignored so newer clients can talk to older servers.
+func (h *Hello) applyExtension(tag uint64, val []byte) error {
+	r := bufio.NewReader(bytes.NewReader(val))
+	switch tag {
+	case ExtFilterPartitions:
+		n, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		if n > uint64(len(val)) {
+			return fmt.Errorf("protocol: bad partition filter count %d", n)
+		}
+		for i := uint64(0); i < n; i++ {
+			p, err := readUvarint(r)
+			if err != nil {
+				return err
+			}
+			h.Filter.Partitions = append(h.Filter.Partitions, p)
+		}
+	case ExtFilterKeyPrefix:
+		h.Filter.KeyPrefix = val
+	case ExtFilterHeader:
+		name, err := readString(r, len(val), "filter header name")
+		if err != nil {
+			return err
+		}
+		value, err := readString(r, len(val), "filter header value")
+		if err != nil {
+			return err
+		}
+		h.Filter.Headers = append(h.Filter.Headers, HeaderField{Name: name, Value: value})
+	case ExtFeatures:
+		f, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		h.Features = f
+	case ExtDataStreams:
+		n, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		h.DataStreams = n
+	}
+	return nil
+}
+
+// readExtensions reads an extension block, passing each extension to apply.
+func readExtensions(r *bufio.Reader, apply func(tag uint64, val []byte) error) error {
+	n, err := readUvarint(r)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		tag, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		l, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		if l > maxHelloExtBytes {
+			return fmt.Errorf("protocol: hello extension too large: %d", l)
+		}
+		val := make([]byte, int(l))
+		if _, err := io.ReadFull(r, val); err != nil {
+			return err
+		}
+		if err := apply(tag, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
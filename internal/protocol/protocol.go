@@ -10,111 +10,232 @@ import (
 )
 
 const (
-	Magic       = "LOOM"
-	VersionByte = 4
+	Magic = "LOOM"
+
+	// Version4 is the original wire format: fixed Hello and message header.
+	Version4 = 4
+	// Version5 adds a Hello extension block and a flags field to the message
+	// header so optional fields can be added without another version bump.
+	Version5 = 5
+	// Version6 adds the server Hello: the server answers every Hello with a
+	// SERVER_HELLO or ERROR frame, and optional features are negotiated.
+	// The client Hello layout is unchanged from v5, so clients announcing a
+	// newer version are negotiated down to this one.
+	Version6 = 6
+
+	// VersionByte is the version written by WriteHello and the newest the
+	// server speaks.
+	VersionByte = Version6
+	// MinVersionByte is the oldest version ReadHello accepts.
+	MinVersionByte = Version4
 
 	FrameAck = uint64(1)
+	// FrameGoAway is sent by the server to v5 producers when it starts
+	// draining. Its value is the time left before the stream is closed, in
+	// milliseconds.
+	FrameGoAway = uint64(2)
+	// FrameError is sent by the server to v5 producers before it closes a
+	// stream it rejected. Its value is an ErrorCode and it is followed by a
+	// length-prefixed message.
+	FrameError = uint64(3)
+	// FrameServerHello answers a v6+ Hello. Its value is the negotiated
+	// version; see ServerHello for the rest of the frame.
+	FrameServerHello = uint64(4)
+	// FramePing asks the peer to answer with a FramePong carrying the same
+	// value. Only sent on streams that negotiated FeaturePing.
+	FramePing = uint64(5)
+	FramePong = uint64(6)
+	// FrameUploadQuery asks for the state of the upload whose id is the
+	// value; the server answers with FrameUploadStatus. Only on streams
+	// that negotiated FeatureResume.
+	FrameUploadQuery  = uint64(7)
+	FrameUploadStatus = uint64(8)
+	// FrameResume asks the server to deliver a retained message again,
+	// from a byte offset; see WriteResume. FrameNotRetained is the answer
+	// when it cannot, with the message id as its value. Only on consumer
+	// streams that negotiated FeatureResume.
+	FrameResume      = uint64(9)
+	FrameNotRetained = uint64(10)
+	// FrameCredit sets a consumer's delivery window; see WriteCredit. Only
+	// on consumer streams that negotiated FeatureCredit.
+	FrameCredit = uint64(11)
+	// FrameDataStream opens a data stream; see WriteDataStreamHeader.
+	FrameDataStream = uint64(12)
+	// FrameBatch is an escaped control frame carrying several messages;
+	// see WriteBatch. Only on streams that negotiated FeatureBatch.
+	FrameBatch = uint64(13)
 
 	RoleProducer = byte('P')
 	RoleConsumer = byte('C')
 )
 
-var ErrBadHandshake = errors.New("protocol: bad handshake")
+// Message header flags (v5+).
+const (
+	// FlagPartition marks a header carrying an explicit partition number.
+	FlagPartition = uint64(1 << 0)
+	// FlagHeaders marks a header carrying application header fields.
+	FlagHeaders = uint64(1 << 1)
+	// FlagUpload marks a producer message that continues a resumable
+	// upload: an upload id and the byte offset its chunks start at.
+	FlagUpload = uint64(1 << 2)
+	// FlagOffset marks a message delivered to a consumer from a byte
+	// offset, after the consumer asked to resume it.
+	FlagOffset = uint64(1 << 3)
+
+	knownHeaderFlags = FlagPartition | FlagHeaders | FlagUpload | FlagOffset
+)
+
+// MaxHeaderFields bounds the number of header fields on a single message.
+const MaxHeaderFields = 64
 
-// WriteHello writes the Loom stream preface.
-func WriteHello(w *bufio.Writer, role byte, name, room, token string) error {
-	if role != RoleProducer && role != RoleConsumer {
-		return fmt.Errorf("protocol: unknown role %q", role)
+// maxHelloExtBytes bounds the size of a single Hello extension value.
+const maxHelloExtBytes = 4096
+
+var (
+	ErrBadHandshake       = errors.New("protocol: bad handshake")
+	ErrUnsupportedVersion = errors.New("protocol: unsupported version")
+)
+
+// Hello is the stream preface sent by clients.
+type Hello struct {
+	Version byte
+	Role    byte
+	Name    string
+	Room    string
+	Token   string
+
+	// Filter restricts which messages are routed to a consumer (v5+).
+	Filter Filter
+	// Features are the Feature* flags the client asks for (v6+).
+	Features uint64
+	// DataStreams is how many data streams a FeatureStreams consumer
+	// accepts at once (v6+). Zero leaves it to the server.
+	DataStreams uint64
+}
+
+// WriteHello writes the Loom stream preface. A zero Version writes VersionByte.
+func WriteHello(w *bufio.Writer, h Hello) error {
+	if h.Role != RoleProducer && h.Role != RoleConsumer {
+		return fmt.Errorf("protocol: unknown role %q", h.Role)
 	}
-	if _, err := w.WriteString(Magic); err != nil {
-		return err
+	if h.Version == 0 {
+		h.Version = VersionByte
 	}
-	if err := w.WriteByte(VersionByte); err != nil {
-		return err
+	if h.Version < MinVersionByte || h.Version > VersionByte {
+		return fmt.Errorf("protocol: unsupported version %d", h.Version)
 	}
-	if err := w.WriteByte(role); err != nil {
+	if _, err := w.WriteString(Magic); err != nil {
 		return err
 	}
-	if err := writeUvarint(w, uint64(len(name))); err != nil {
+	if err := w.WriteByte(h.Version); err != nil {
 		return err
 	}
-	if _, err := w.WriteString(name); err != nil {
+	if err := w.WriteByte(h.Role); err != nil {
 		return err
 	}
-	if err := writeUvarint(w, uint64(len(room))); err != nil {
+	if err := writeString(w, h.Name); err != nil {
 		return err
 	}
-	if _, err := w.WriteString(room); err != nil {
+	if err := writeString(w, h.Room); err != nil {
 		return err
 	}
-	if err := writeUvarint(w, uint64(len(token))); err != nil {
+	if err := writeString(w, h.Token); err != nil {
 		return err
 	}
-	if _, err := w.WriteString(token); err != nil {
-		return err
+	if h.Version >= Version5 {
+		if err := writeHelloExtensions(w, h); err != nil {
+			return err
+		}
 	}
 	return w.Flush()
 }
 
-// ReadHello reads the Loom stream preface.
-func ReadHello(r *bufio.Reader, maxNameBytes, maxRoomBytes, maxTokenBytes int) (role byte, name, room, token string, err error) {
+// ReadHello reads the Loom stream preface. A version newer than VersionByte
+// is negotiated down to VersionByte. On error the returned Hello holds
+// whatever was read before the failure, so callers can still tell which role
+// and version the client asked for.
+func ReadHello(r *bufio.Reader, maxNameBytes, maxRoomBytes, maxTokenBytes int) (Hello, error) {
 	var preface [len(Magic) + 2]byte
 	if _, err := io.ReadFull(r, preface[:]); err != nil {
-		return 0, "", "", "", err
+		return Hello{}, err
 	}
 	if string(preface[:len(Magic)]) != Magic {
-		return 0, "", "", "", ErrBadHandshake
+		return Hello{}, ErrBadHandshake
 	}
-	if preface[len(Magic)] != VersionByte {
-		return 0, "", "", "", ErrBadHandshake
+	h := Hello{
+		Version: preface[len(Magic)],
+		Role:    preface[len(Magic)+1],
 	}
-	role = preface[len(Magic)+1]
-	nameLen, err := readUvarint(r)
-	if err != nil {
-		return 0, "", "", "", err
-	}
-	if nameLen > uint64(maxNameBytes) {
-		return 0, "", "", "", fmt.Errorf("protocol: name too large: %d", nameLen)
+	if h.Version < MinVersionByte {
+		return h, ErrUnsupportedVersion
 	}
-	nameBuf := make([]byte, int(nameLen))
-	if _, err := io.ReadFull(r, nameBuf); err != nil {
-		return 0, "", "", "", err
+	if h.Version > VersionByte {
+		h.Version = VersionByte
 	}
 
-	roomLen, err := readUvarint(r)
+	name, err := readString(r, maxNameBytes, "name")
 	if err != nil {
-		return 0, "", "", "", err
-	}
-	if roomLen > uint64(maxRoomBytes) {
-		return 0, "", "", "", fmt.Errorf("protocol: room too large: %d", roomLen)
+		return h, err
 	}
-	roomBuf := make([]byte, int(roomLen))
-	if _, err := io.ReadFull(r, roomBuf); err != nil {
-		return 0, "", "", "", err
-	}
-
-	tokLen, err := readUvarint(r)
+	room, err := readString(r, maxRoomBytes, "room")
 	if err != nil {
-		return 0, "", "", "", err
+		return h, err
 	}
-	if tokLen > uint64(maxTokenBytes) {
-		return 0, "", "", "", fmt.Errorf("protocol: token too large: %d", tokLen)
+	token, err := readString(r, maxTokenBytes, "token")
+	if err != nil {
+		return h, err
 	}
-	tokBuf := make([]byte, int(tokLen))
-	if _, err := io.ReadFull(r, tokBuf); err != nil {
-		return 0, "", "", "", err
+	h.Name, h.Room, h.Token = name, room, token
+
+	if h.Version >= Version5 {
+		if err := readExtensions(r, h.applyExtension); err != nil {
+			return h, err
+		}
 	}
+	return h, nil
+}
 
-	return role, string(nameBuf), string(roomBuf), string(tokBuf), nil
+// HeaderField is a single application header on a message (v5+).
+type HeaderField struct {
+	Name  string
+	Value string
 }
 
 type MessageHeader struct {
 	Key          []byte
 	DeclaredSize uint64
 	MsgID        uint64
+
+	// Partition is only meaningful when HasPartition is set (v5+).
+	Partition    uint64
+	HasPartition bool
+
+	Headers []HeaderField
+
+	// UploadID and UploadOffset are only meaningful when HasUpload is set
+	// (v6+, FeatureResume). Producers only.
+	UploadID     uint64
+	UploadOffset uint64
+	HasUpload    bool
+
+	// Offset is the position of the first chunk within the message; only
+	// meaningful when HasOffset is set (v6+, FeatureResume). Consumers
+	// only.
+	Offset    uint64
+	HasOffset bool
+}
+
+// Header returns the value of the first header field with the given name.
+func (h MessageHeader) Header(name string) (string, bool) {
+	for _, f := range h.Headers {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return "", false
 }
 
-func ReadMessageHeader(r *bufio.Reader, maxKeyBytes int) (MessageHeader, error) {
+func ReadMessageHeader(r *bufio.Reader, version byte, maxKeyBytes int) (MessageHeader, error) {
 	keyLen, err := readUvarint(r)
 	if err != nil {
 		return MessageHeader{}, err
@@ -137,25 +258,137 @@ func ReadMessageHeader(r *bufio.Reader, maxKeyBytes int) (MessageHeader, error)
 	if err != nil {
 		return MessageHeader{}, err
 	}
-	return MessageHeader{Key: key, DeclaredSize: sz, MsgID: msgID}, nil
+	hdr := MessageHeader{Key: key, DeclaredSize: sz, MsgID: msgID}
+	if version < Version5 {
+		return hdr, nil
+	}
+
+	flags, err := readUvarint(r)
+	if err != nil {
+		return MessageHeader{}, err
+	}
+	if flags&^knownHeaderFlags != 0 {
+		return MessageHeader{}, fmt.Errorf("protocol: unknown header flags %#x - stream likely corrupted", flags)
+	}
+	if flags&FlagPartition != 0 {
+		part, err := readUvarint(r)
+		if err != nil {
+			return MessageHeader{}, err
+		}
+		hdr.Partition = part
+		hdr.HasPartition = true
+	}
+	if flags&FlagHeaders != 0 {
+		n, err := readUvarint(r)
+		if err != nil {
+			return MessageHeader{}, err
+		}
+		if n > MaxHeaderFields {
+			return MessageHeader{}, fmt.Errorf("protocol: too many header fields: %d (max %d)", n, MaxHeaderFields)
+		}
+		hdr.Headers = make([]HeaderField, 0, int(n))
+		for i := uint64(0); i < n; i++ {
+			name, err := readString(r, maxKeyBytes, "header name")
+			if err != nil {
+				return MessageHeader{}, err
+			}
+			value, err := readString(r, maxKeyBytes, "header value")
+			if err != nil {
+				return MessageHeader{}, err
+			}
+			hdr.Headers = append(hdr.Headers, HeaderField{Name: name, Value: value})
+		}
+	}
+	if flags&FlagUpload != 0 {
+		if hdr.UploadID, err = readUvarint(r); err != nil {
+			return MessageHeader{}, err
+		}
+		if hdr.UploadOffset, err = readUvarint(r); err != nil {
+			return MessageHeader{}, err
+		}
+		hdr.HasUpload = true
+	}
+	if flags&FlagOffset != 0 {
+		if hdr.Offset, err = readUvarint(r); err != nil {
+			return MessageHeader{}, err
+		}
+		hdr.HasOffset = true
+	}
+	return hdr, nil
 }
 
-func WriteMessageHeader(w *bufio.Writer, key []byte, declaredSize uint64, msgID uint64) error {
-	if len(key) == 0 {
+// WriteMessageHeader writes hdr in the given protocol version. Fields that the
+// version cannot carry are omitted.
+func WriteMessageHeader(w *bufio.Writer, version byte, hdr MessageHeader) error {
+	if len(hdr.Key) == 0 {
 		return errors.New("protocol: empty key")
 	}
-	if err := writeUvarint(w, uint64(len(key))); err != nil {
+	if len(hdr.Headers) > MaxHeaderFields {
+		return fmt.Errorf("protocol: too many header fields: %d (max %d)", len(hdr.Headers), MaxHeaderFields)
+	}
+	if err := writeUvarint(w, uint64(len(hdr.Key))); err != nil {
 		return err
 	}
-	if _, err := w.Write(key); err != nil {
+	if _, err := w.Write(hdr.Key); err != nil {
 		return err
 	}
-	if err := writeUvarint(w, declaredSize); err != nil {
+	if err := writeUvarint(w, hdr.DeclaredSize); err != nil {
 		return err
 	}
-	if err := writeUvarint(w, msgID); err != nil {
+	if err := writeUvarint(w, hdr.MsgID); err != nil {
 		return err
 	}
+	if version < Version5 {
+		return nil
+	}
+
+	var flags uint64
+	if hdr.HasPartition {
+		flags |= FlagPartition
+	}
+	if len(hdr.Headers) > 0 {
+		flags |= FlagHeaders
+	}
+	if hdr.HasUpload {
+		flags |= FlagUpload
+	}
+	if hdr.HasOffset {
+		flags |= FlagOffset
+	}
+	if err := writeUvarint(w, flags); err != nil {
+		return err
+	}
+	if hdr.HasPartition {
+		if err := writeUvarint(w, hdr.Partition); err != nil {
+			return err
+		}
+	}
+	if len(hdr.Headers) > 0 {
+		if err := writeUvarint(w, uint64(len(hdr.Headers))); err != nil {
+			return err
+		}
+		for _, f := range hdr.Headers {
+			if err := writeString(w, f.Name); err != nil {
+				return err
+			}
+			if err := writeString(w, f.Value); err != nil {
+				return err
+			}
+		}
+	}
+	if hdr.HasUpload {
+		if err := writeUvarint(w, hdr.UploadID); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, hdr.UploadOffset); err != nil {
+			return err
+		}
+	}
+	if hdr.HasOffset {
+		if err := writeUvarint(w, hdr.Offset); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -193,6 +426,36 @@ func WriteEndOfMessage(w *bufio.Writer) error {
 	return writeUvarint(w, 0)
 }
 
+// End codes follow the end-of-message marker on streams that negotiated
+// FeatureAbort.
+const (
+	EndComplete = uint64(0)
+	// EndAborted tells the receiver to discard the message; it is not ACKed.
+	EndAborted = uint64(1)
+)
+
+// WriteMessageEnd writes the end-of-message marker followed by an end code,
+// for streams that negotiated FeatureAbort.
+func WriteMessageEnd(w *bufio.Writer, code uint64) error {
+	if err := WriteEndOfMessage(w); err != nil {
+		return err
+	}
+	return writeUvarint(w, code)
+}
+
+// ReadEndCode reads the end code after ReadChunk reported the end of a
+// message on a stream that negotiated FeatureAbort.
+func ReadEndCode(r *bufio.Reader) (uint64, error) {
+	code, err := readUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if code != EndComplete && code != EndAborted {
+		return 0, fmt.Errorf("protocol: unknown end code %d", code)
+	}
+	return code, nil
+}
+
 func DiscardMessage(r *bufio.Reader, maxChunkBytes int) error {
 	for {
 		n, err := readUvarint(r)
@@ -218,6 +481,29 @@ func writeUvarint(w io.Writer, v uint64) error {
 	return err
 }
 
+func writeString(w *bufio.Writer, s string) error {
+	if err := writeUvarint(w, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func readString(r *bufio.Reader, max int, what string) (string, error) {
+	n, err := readUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(max) {
+		return "", fmt.Errorf("protocol: %s too large: %d", what, n)
+	}
+	buf := make([]byte, int(n))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
 func readUvarint(r *bufio.Reader) (uint64, error) {
 	v, err := binary.ReadUvarint(r)
 	if err != nil {
@@ -240,6 +526,18 @@ func WriteAck(w *bufio.Writer, msgID uint64) error {
 	return w.Flush()
 }
 
+// WriteGoAway writes a GOAWAY frame telling a producer to finish its current
+// message and reconnect elsewhere.
+func WriteGoAway(w *bufio.Writer, remainingMillis uint64) error {
+	if err := writeUvarint(w, FrameGoAway); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, remainingMillis); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
 func ReadFrame(r *bufio.Reader) (frameType uint64, msgID uint64, err error) {
 	ft, err := readUvarint(r)
 	if err != nil {
@@ -253,9 +551,9 @@ func ReadFrame(r *bufio.Reader) (frameType uint64, msgID uint64, err error) {
 }
 
 // EncodeHello is a convenience for tests and debugging.
-func EncodeHello(role byte, name, room, token string) []byte {
+func EncodeHello(h Hello) []byte {
 	var buf bytes.Buffer
 	w := bufio.NewWriter(&buf)
-	_ = WriteHello(w, role, name, room, token)
+	_ = WriteHello(w, h)
 	return buf.Bytes()
 }
@@ -3,30 +3,31 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"testing"
 )
 
 func TestHelloRoundTrip(t *testing.T) {
 	var b bytes.Buffer
 	w := bufio.NewWriter(&b)
-	if err := WriteHello(w, RoleProducer, "p1", "room", "tok"); err != nil {
+	if err := WriteHello(w, Hello{Role: RoleProducer, Name: "p1", Room: "room", Token: "tok"}); err != nil {
 		t.Fatal(err)
 	}
 
 	r := bufio.NewReader(bytes.NewReader(b.Bytes()))
-	role, name, room, token, err := ReadHello(r, 32, 32, 32)
+	h, err := ReadHello(r, 32, 32, 32)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if role != RoleProducer || name != "p1" || room != "room" || token != "tok" {
-		t.Fatalf("unexpected hello: role=%c name=%q room=%q token=%q", role, name, room, token)
+	if h.Version != VersionByte || h.Role != RoleProducer || h.Name != "p1" || h.Room != "room" || h.Token != "tok" {
+		t.Fatalf("unexpected hello: %+v", h)
 	}
 }
 
 func TestMessageHeaderChunkAckRoundTrip(t *testing.T) {
 	var b bytes.Buffer
 	w := bufio.NewWriter(&b)
-	if err := WriteMessageHeader(w, []byte("k"), 123, 42); err != nil {
+	if err := WriteMessageHeader(w, Version4, MessageHeader{Key: []byte("k"), DeclaredSize: 123, MsgID: 42}); err != nil {
 		t.Fatal(err)
 	}
 	if err := WriteChunk(w, []byte("abc")); err != nil {
@@ -40,7 +41,7 @@ func TestMessageHeaderChunkAckRoundTrip(t *testing.T) {
 	}
 
 	r := bufio.NewReader(bytes.NewReader(b.Bytes()))
-	h, err := ReadMessageHeader(r, 8)
+	h, err := ReadMessageHeader(r, Version4, 8)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,3 +70,377 @@ func TestMessageHeaderChunkAckRoundTrip(t *testing.T) {
 		t.Fatalf("unexpected frame: type=%d msgID=%d", ft, mid)
 	}
 }
+
+func TestV4HelloAccepted(t *testing.T) {
+	b := EncodeHello(Hello{Version: Version4, Role: RoleConsumer, Name: "c1", Room: "r"})
+	h, err := ReadHello(bufio.NewReader(bytes.NewReader(b)), 32, 32, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != Version4 || h.Role != RoleConsumer || h.Name != "c1" || h.Room != "r" {
+		t.Fatalf("unexpected hello: %+v", h)
+	}
+}
+
+func TestUnsupportedVersionKeepsRole(t *testing.T) {
+	b := append([]byte(Magic), MinVersionByte-1, RoleProducer)
+	h, err := ReadHello(bufio.NewReader(bytes.NewReader(b)), 32, 32, 32)
+	if err != ErrUnsupportedVersion {
+		t.Fatalf("err = %v, want ErrUnsupportedVersion", err)
+	}
+	if h.Version != MinVersionByte-1 || h.Role != RoleProducer {
+		t.Fatalf("unexpected hello: %+v", h)
+	}
+}
+
+func TestNewerHelloNegotiatedDown(t *testing.T) {
+	b := EncodeHello(Hello{Role: RoleConsumer, Name: "c1", Room: "r", Features: FeatureHeaders | FeatureCompression})
+	b[len(Magic)] = VersionByte + 3
+	h, err := ReadHello(bufio.NewReader(bytes.NewReader(b)), 32, 32, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != VersionByte || h.Name != "c1" {
+		t.Fatalf("unexpected hello: %+v", h)
+	}
+	if h.Features != FeatureHeaders|FeatureCompression {
+		t.Fatalf("features = %b", h.Features)
+	}
+	if got := h.GrantedFeatures(); got != FeatureHeaders {
+		t.Fatalf("granted = %b, want headers only", got)
+	}
+}
+
+func TestServerHelloRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	want := ServerHello{
+		Version:          Version6,
+		Features:         FeatureHeaders,
+		MaxChunkBytes:    64 << 10,
+		MaxMessageBytes:  256 << 20,
+		MaxKeyBytes:      256,
+		Principal:        "alice",
+		ConsumerID:       "c-7",
+		NodeID:           "loom-1",
+		DataStreams:      4,
+		DatagramMaxBytes: 1000,
+	}
+	if err := WriteServerHello(bufio.NewWriter(&b), want); err != nil {
+		t.Fatal(err)
+	}
+	sh, err := ReadServerHello(bufio.NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh != want {
+		t.Fatalf("server hello = %+v, want %+v", sh, want)
+	}
+
+	b.Reset()
+	if err := WriteError(bufio.NewWriter(&b), ErrorUnauthorized, "invalid token"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadServerHello(bufio.NewReader(&b))
+	var se *StreamError
+	if !errors.As(err, &se) || se.Code != ErrorUnauthorized {
+		t.Fatalf("err = %v, want unauthorized StreamError", err)
+	}
+}
+
+func TestErrorFrameRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteError(bufio.NewWriter(&b), ErrorRoomPaused, "room paused"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&b)
+	ft, code, err := ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft != FrameError {
+		t.Fatalf("frame type = %d, want %d", ft, FrameError)
+	}
+	se, err := ReadErrorMessage(r, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se.Code != ErrorRoomPaused || se.Message != "room paused" || !se.Code.Retryable() {
+		t.Fatalf("unexpected error: %+v", se)
+	}
+	if se.Error() != "protocol: server error room_paused: room paused" {
+		t.Fatalf("Error() = %q", se.Error())
+	}
+}
+
+func TestMessageEndCodes(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	for _, code := range []uint64{EndAborted, EndComplete, 7} {
+		if err := WriteChunk(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteMessageEnd(w, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&b)
+	for _, want := range []uint64{EndAborted, EndComplete} {
+		if err := DiscardMessage(r, 16); err != nil {
+			t.Fatal(err)
+		}
+		code, err := ReadEndCode(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Fatalf("end code = %d, want %d", code, want)
+		}
+	}
+	if err := DiscardMessage(r, 16); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadEndCode(r); err == nil {
+		t.Fatal("expected error for unknown end code")
+	}
+}
+
+func TestMessageHeaderPartitionRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	in := MessageHeader{Key: []byte("k"), MsgID: 7, Partition: 3, HasPartition: true}
+	if err := WriteMessageHeader(w, Version5, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMessageHeader(w, Version5, MessageHeader{Key: []byte("k2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(b.Bytes()))
+	h, err := ReadMessageHeader(r, Version5, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.HasPartition || h.Partition != 3 || h.MsgID != 7 {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+	h, err = ReadMessageHeader(r, Version5, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.HasPartition || string(h.Key) != "k2" {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+}
+
+func TestUploadRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	in := MessageHeader{Key: []byte("k"), DeclaredSize: 100, HasUpload: true, UploadID: 42, UploadOffset: 60}
+	if err := WriteMessageHeader(w, Version6, in); err != nil {
+		t.Fatal(err)
+	}
+	st := UploadStatus{ID: 42, Offset: 60, State: UploadPartial}
+	if err := WriteUploadStatus(w, st); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&b)
+	h, err := ReadMessageHeader(r, Version6, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.HasUpload || h.UploadID != 42 || h.UploadOffset != 60 || h.DeclaredSize != 100 {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+	ft, id, err := ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft != FrameUploadStatus {
+		t.Fatalf("frame type = %d, want %d", ft, FrameUploadStatus)
+	}
+	got, err := ReadUploadStatus(r, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != st {
+		t.Fatalf("upload status = %+v, want %+v", got, st)
+	}
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := WriteResume(w, 9, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMessageHeader(w, Version6, MessageHeader{Key: []byte("k"), MsgID: 9, Offset: 1000, HasOffset: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&b)
+	ft, id, err := ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := ReadResumeOffset(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft != FrameResume || id != 9 || offset != 1000 {
+		t.Fatalf("resume = %d, %d, %d", ft, id, offset)
+	}
+	h, err := ReadMessageHeader(r, Version6, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.HasOffset || h.Offset != 1000 || h.MsgID != 9 {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+}
+
+func TestDataStreamRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := WriteHello(w, Hello{Version: Version6, Role: RoleConsumer, Room: "r", Features: FeatureStreams, DataStreams: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDataStreamHeader(w, "c-7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&b)
+	h, err := ReadHello(r, 64, 64, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.DataStreams != 3 || h.GrantedFeatures()&FeatureStreams == 0 {
+		t.Fatalf("unexpected hello: %+v", h)
+	}
+	id, err := ReadDataStreamHeader(r, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "c-7" {
+		t.Fatalf("consumer id = %q", id)
+	}
+	if _, err := ReadDataStreamHeader(bufio.NewReader(bytes.NewReader([]byte{byte(FrameAck), 1})), 64); err == nil {
+		t.Fatal("expected error for a stream without a data stream header")
+	}
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	hdr := MessageHeader{Key: []byte("k"), MsgID: 3, Partition: 2, HasPartition: true}
+	b, err := AppendDatagram(nil, 12, Version6, hdr, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, rest, err := DatagramStreamID(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 12 {
+		t.Fatalf("stream id = %d, want 12", id)
+	}
+	got, payload, err := ReadDatagramMessage(rest, Version6, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Key) != "k" || got.MsgID != 3 || got.Partition != 2 || string(payload) != "payload" {
+		t.Fatalf("datagram = %+v, %q", got, payload)
+	}
+	if _, _, err := DatagramStreamID(nil); err == nil {
+		t.Fatal("expected error for an empty datagram")
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	entries := []BatchEntry{
+		{Header: MessageHeader{Key: []byte("a"), MsgID: 5}, Payload: []byte("one")},
+		{Header: MessageHeader{Key: []byte("b"), MsgID: 5, Partition: 1, HasPartition: true}, Payload: nil},
+	}
+	var b bytes.Buffer
+	if err := WriteBatch(bufio.NewWriter(&b), Version6, entries); err != nil {
+		t.Fatal(err)
+	}
+	raw := b.Bytes()
+
+	r := bufio.NewReader(bytes.NewReader(raw))
+	if ctl, err := IsControlFrame(r); err != nil || !ctl {
+		t.Fatalf("batch is not a control frame: %v, %v", ctl, err)
+	}
+	ft, n, err := ReadControlFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft != FrameBatch || n != 2 {
+		t.Fatalf("frame = %d, count %d", ft, n)
+	}
+	got, err := ReadBatch(r, Version6, n, 8, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[0].Header.Key) != "a" || string(got[0].Payload) != "one" ||
+		string(got[1].Header.Key) != "b" || got[1].Header.Partition != 1 || len(got[1].Payload) != 0 {
+		t.Fatalf("batch = %+v", got)
+	}
+
+	r = bufio.NewReader(bytes.NewReader(raw))
+	_, n, _ = ReadControlFrame(r)
+	if _, err := ReadBatch(r, Version6, n, 8, 2); err == nil {
+		t.Fatal("expected error for a batch over the byte limit")
+	}
+	if err := WriteBatch(bufio.NewWriter(&b), Version6, nil); err == nil {
+		t.Fatal("expected error for an empty batch")
+	}
+}
+
+func TestHelloFilterAndHeadersRoundTrip(t *testing.T) {
+	in := Hello{
+		Role: RoleConsumer,
+		Name: "c",
+		Filter: Filter{
+			Partitions: []uint64{1, 9},
+			KeyPrefix:  []byte("img/"),
+			Headers:    []HeaderField{{Name: "type", Value: "log"}},
+		},
+	}
+	h, err := ReadHello(bufio.NewReader(bytes.NewReader(EncodeHello(in))), 32, 32, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.Filter
+	if len(f.Partitions) != 2 || f.Partitions[1] != 9 || string(f.KeyPrefix) != "img/" ||
+		len(f.Headers) != 1 || f.Headers[0] != (HeaderField{Name: "type", Value: "log"}) {
+		t.Fatalf("unexpected filter: %+v", f)
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	hdr := MessageHeader{Key: []byte("k"), Headers: []HeaderField{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}}
+	if err := WriteMessageHeader(w, Version5, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMessageHeader(bufio.NewReader(&b), Version5, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := got.Header("b"); !ok || v != "2" || len(got.Headers) != 2 {
+		t.Fatalf("unexpected headers: %+v", got.Headers)
+	}
+}
@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+)
+
+// Feature flags negotiated by the Hello exchange (v6+). A client asks for
+// features with the ExtFeatures Hello extension and may use those the
+// server grants in its ServerHello.
+const (
+	// FeatureHeaders: message headers may carry application header fields.
+	// Built into v5 and always granted.
+	FeatureHeaders = uint64(1 << 0)
+	// FeatureReceipts: the server ACKs each producer message once it has
+	// been delivered.
+	FeatureReceipts = uint64(1 << 1)
+	// FeatureCompression: chunk payloads may be compressed.
+	FeatureCompression = uint64(1 << 2)
+	// FeatureChecksums: messages may carry a payload checksum.
+	FeatureChecksums = uint64(1 << 3)
+	// FeaturePing: the server sends PING frames that the client must answer,
+	// and closes streams that stay silent past its idle timeout.
+	FeaturePing = uint64(1 << 4)
+	// FeatureAbort: every end-of-message marker is followed by an end code,
+	// so a message can be aborted part way through.
+	FeatureAbort = uint64(1 << 5)
+	// FeatureResume: producers may stage messages as resumable uploads
+	// (FlagUpload) and query their progress. Servers without a staging
+	// area do not grant it.
+	FeatureResume = uint64(1 << 6)
+	// FeatureCredit: consumers set how many messages and bytes may be
+	// awaiting their ACK at once with CREDIT frames.
+	FeatureCredit = uint64(1 << 7)
+	// FeatureStreams: the server may deliver each message to a consumer on
+	// a unidirectional data stream of its own, so several messages are in
+	// flight at once. QUIC only.
+	FeatureStreams = uint64(1 << 8)
+	// FeatureDatagrams: small messages may travel in QUIC DATAGRAM frames,
+	// best effort. QUIC only, and only in rooms that enable it.
+	FeatureDatagrams = uint64(1 << 9)
+	// FeatureBatch: several small messages may travel in one BATCH frame,
+	// and a consumer ACKs a batch with one ACK.
+	FeatureBatch = uint64(1 << 10)
+
+	// SupportedFeatures is the set of features this implementation grants.
+	SupportedFeatures = FeatureHeaders | FeaturePing | FeatureAbort | FeatureResume | FeatureCredit | FeatureStreams | FeatureDatagrams | FeatureBatch
+)
+
+// GrantedFeatures returns the features the server grants for h: those it
+// asked for and the server supports, plus those built into its version.
+func (h Hello) GrantedFeatures() uint64 {
+	granted := h.Features & SupportedFeatures
+	if h.Version >= Version5 {
+		granted |= FeatureHeaders
+	}
+	return granted
+}
+
+// ServerHello extension tags. Zero or empty fields are omitted.
+const (
+	// ServerExtMaxChunkBytes: the room's max_chunk_bytes (uvarint).
+	ServerExtMaxChunkBytes = uint64(1)
+	// ServerExtMaxMessageBytes: the room's max_message_bytes (uvarint).
+	ServerExtMaxMessageBytes = uint64(2)
+	// ServerExtMaxKeyBytes: the room's max_key_bytes (uvarint).
+	ServerExtMaxKeyBytes = uint64(3)
+	// ServerExtPrincipal: the authenticated principal (raw bytes).
+	ServerExtPrincipal = uint64(4)
+	// ServerExtConsumerID: the consumer id assigned to the stream (raw
+	// bytes). Consumers only.
+	ServerExtConsumerID = uint64(5)
+	// ServerExtNodeID: the identity of the server node (raw bytes).
+	ServerExtNodeID = uint64(6)
+	// ServerExtDataStreams: how many data streams the server may have open
+	// to the consumer at once (uvarint). FeatureStreams consumers only.
+	ServerExtDataStreams = uint64(7)
+	// ServerExtDatagramMaxBytes: the largest payload a message sent as a
+	// datagram may have (uvarint). FeatureDatagrams sessions only.
+	ServerExtDatagramMaxBytes = uint64(8)
+)
+
+// ServerHello is the server's answer to a v6+ Hello.
+//
+// Wire format: FrameServerHello (uvarint), version (uvarint), features
+// (uvarint), then an extension block shaped like the client Hello's.
+type ServerHello struct {
+	Version  byte
+	Features uint64
+
+	// Effective limits for the room.
+	MaxChunkBytes   uint64
+	MaxMessageBytes uint64
+	MaxKeyBytes     uint64
+
+	Principal  string
+	ConsumerID string
+	NodeID     string
+
+	DataStreams      uint64
+	DatagramMaxBytes uint64
+}
+
+func (sh ServerHello) extensions() []helloExtension {
+	var exts []helloExtension
+	for _, e := range []struct {
+		tag uint64
+		v   uint64
+	}{
+		{ServerExtMaxChunkBytes, sh.MaxChunkBytes},
+		{ServerExtMaxMessageBytes, sh.MaxMessageBytes},
+		{ServerExtMaxKeyBytes, sh.MaxKeyBytes},
+		{ServerExtDataStreams, sh.DataStreams},
+		{ServerExtDatagramMaxBytes, sh.DatagramMaxBytes},
+	} {
+		if e.v != 0 {
+			exts = append(exts, uvarintExtension(e.tag, e.v))
+		}
+	}
+	for _, e := range []struct {
+		tag uint64
+		v   string
+	}{
+		{ServerExtPrincipal, sh.Principal},
+		{ServerExtConsumerID, sh.ConsumerID},
+		{ServerExtNodeID, sh.NodeID},
+	} {
+		if e.v != "" {
+			exts = append(exts, helloExtension{e.tag, []byte(e.v)})
+		}
+	}
+	return exts
+}
+
+// WriteServerHello writes a SERVER_HELLO frame.
+func WriteServerHello(w *bufio.Writer, sh ServerHello) error {
+	if err := writeUvarint(w, FrameServerHello); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, uint64(sh.Version)); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, sh.Features); err != nil {
+		return err
+	}
+	if err := writeExtensions(w, sh.extensions()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ReadServerHello reads the server's answer to a v6+ Hello. If the server
+// rejected the stream it returns the *StreamError from its ERROR frame.
+func ReadServerHello(r *bufio.Reader) (ServerHello, error) {
+	ft, v, err := ReadFrame(r)
+	if err != nil {
+		return ServerHello{}, err
+	}
+	switch ft {
+	case FrameServerHello:
+	case FrameError:
+		se, err := ReadErrorMessage(r, v)
+		if err != nil {
+			return ServerHello{}, err
+		}
+		return ServerHello{}, se
+	default:
+		return ServerHello{}, fmt.Errorf("protocol: unexpected frame %d before server hello", ft)
+	}
+	if v < Version6 || v > 255 {
+		return ServerHello{}, fmt.Errorf("protocol: bad server hello version %d", v)
+	}
+	sh := ServerHello{Version: byte(v)}
+	if sh.Features, err = readUvarint(r); err != nil {
+		return ServerHello{}, err
+	}
+	if err := readExtensions(r, sh.applyExtension); err != nil {
+		return ServerHello{}, err
+	}
+	return sh, nil
+}
+
+// applyExtension decodes a single ServerHello extension into sh. Unknown
+// tags are ignored.
+func (sh *ServerHello) applyExtension(tag uint64, val []byte) error {
+	var dst *uint64
+	switch tag {
+	case ServerExtMaxChunkBytes:
+		dst = &sh.MaxChunkBytes
+	case ServerExtMaxMessageBytes:
+		dst = &sh.MaxMessageBytes
+	case ServerExtMaxKeyBytes:
+		dst = &sh.MaxKeyBytes
+	case ServerExtDataStreams:
+		dst = &sh.DataStreams
+	case ServerExtDatagramMaxBytes:
+		dst = &sh.DatagramMaxBytes
+	case ServerExtPrincipal:
+		sh.Principal = string(val)
+	case ServerExtConsumerID:
+		sh.ConsumerID = string(val)
+	case ServerExtNodeID:
+		sh.NodeID = string(val)
+	}
+	if dst != nil {
+		v, err := readUvarint(bufio.NewReader(bytes.NewReader(val)))
+		if err != nil {
+			return err
+		}
+		*dst = v
+	}
+	return nil
+}
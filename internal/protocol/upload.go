@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// UploadState is the server's view of a resumable upload.
+type UploadState uint64
+
+const (
+	// UploadUnknown: nothing is staged under the id, or it expired.
+	UploadUnknown UploadState = 0
+	// UploadPartial: Offset bytes are staged; continue from there.
+	UploadPartial UploadState = 1
+	// UploadComplete: the whole message (Offset bytes) was received and
+	// handed to the router. It must not be sent again.
+	UploadComplete UploadState = 2
+)
+
+func (s UploadState) String() string {
+	switch s {
+	case UploadUnknown:
+		return "unknown"
+	case UploadPartial:
+		return "partial"
+	case UploadComplete:
+		return "complete"
+	default:
+		return fmt.Sprintf("upload_state(%d)", uint64(s))
+	}
+}
+
+// UploadStatus answers a FrameUploadQuery, or a resumed message whose
+// offset did not match the staged bytes.
+//
+// Wire format: FrameUploadStatus (uvarint), upload id (uvarint), offset
+// (uvarint), state (uvarint).
+type UploadStatus struct {
+	ID     uint64
+	Offset uint64
+	State  UploadState
+}
+
+// WriteUploadStatus writes an UPLOAD_STATUS frame and flushes it.
+func WriteUploadStatus(w *bufio.Writer, st UploadStatus) error {
+	if err := writeUvarint(w, FrameUploadStatus); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, st.ID); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, st.Offset); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, uint64(st.State)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ReadUploadStatus reads the rest of an UPLOAD_STATUS frame after ReadFrame
+// returned FrameUploadStatus and the upload id.
+func ReadUploadStatus(r *bufio.Reader, id uint64) (UploadStatus, error) {
+	offset, err := readUvarint(r)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	state, err := readUvarint(r)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	if state > uint64(UploadComplete) {
+		return UploadStatus{}, fmt.Errorf("protocol: unknown upload state %d", state)
+	}
+	return UploadStatus{ID: id, Offset: offset, State: UploadState(state)}, nil
+}
+
+// WriteResume asks for the retained message msgID to be delivered again,
+// starting at byte offset, and flushes the frame.
+//
+// Wire format: FrameResume (uvarint), msg id (uvarint), offset (uvarint).
+func WriteResume(w *bufio.Writer, msgID, offset uint64) error {
+	if err := writeUvarint(w, FrameResume); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, msgID); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, offset); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ReadResumeOffset reads the offset of a RESUME frame after ReadFrame
+// returned FrameResume and the message id.
+func ReadResumeOffset(r *bufio.Reader) (uint64, error) {
+	return readUvarint(r)
+}
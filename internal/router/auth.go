@@ -2,12 +2,19 @@ package router
 
 import (
 	"crypto/x509"
+	"strings"
 
+	"github.com/BurntRouter/Loom/internal/audit"
 	"github.com/BurntRouter/Loom/internal/auth"
 	"github.com/BurntRouter/Loom/internal/config"
+	"github.com/BurntRouter/Loom/internal/metrics"
 	quic "github.com/quic-go/quic-go"
 )
 
+// anonymousPrincipal is the principal of every client while auth is
+// disabled.
+const anonymousPrincipal = "anonymous"
+
 type AuthContext struct {
 	Mode       config.AuthMode
 	Authorizer *auth.Authorizer
@@ -16,7 +23,7 @@ type AuthContext struct {
 func (a AuthContext) authorizeQUIC(conn *quic.Conn, token string, room string, role auth.Role) auth.Decision {
 	switch a.Mode {
 	case config.AuthModeDisabled:
-		return auth.Decision{Allowed: true, Principal: "anonymous"}
+		return auth.Decision{Allowed: true, Principal: anonymousPrincipal}
 	case config.AuthModeToken:
 		return a.Authorizer.AuthorizeToken(token, room, role)
 	case config.AuthModeMTLS:
@@ -37,6 +44,25 @@ func (a AuthContext) authorizeQUIC(conn *quic.Conn, token string, room string, r
 	}
 }
 
+// recordDecision counts d and writes it to the audit log.
+func recordDecision(d auth.Decision, room string, role auth.Role, remoteAddr, transport string) {
+	result, reason := audit.ResultAllow, "ok"
+	if !d.Allowed {
+		result, reason = audit.ResultDeny, strings.ReplaceAll(d.Reason, " ", "_")
+	}
+	metrics.AuthDecisions.WithLabelValues(result, reason).Inc()
+	audit.Record(audit.Event{
+		Kind:       audit.KindAuth,
+		Result:     result,
+		Reason:     d.Reason,
+		Principal:  d.Principal,
+		Room:       room,
+		Role:       string(role),
+		RemoteAddr: remoteAddr,
+		Transport:  transport,
+	})
+}
+
 func peerCertFromQUIC(conn *quic.Conn) *x509.Certificate {
 	st := conn.ConnectionState()
 	if len(st.TLS.PeerCertificates) == 0 {
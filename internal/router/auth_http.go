@@ -11,7 +11,7 @@ import (
 func (a AuthContext) authorizeHTTP(r *http.Request, token string, room string, role auth.Role) auth.Decision {
 	switch a.Mode {
 	case config.AuthModeDisabled:
-		return auth.Decision{Allowed: true, Principal: "anonymous"}
+		return auth.Decision{Allowed: true, Principal: anonymousPrincipal}
 	case config.AuthModeToken:
 		return a.Authorizer.AuthorizeToken(token, room, role)
 	case config.AuthModeMTLS:
@@ -0,0 +1,170 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/metrics"
+	"github.com/BurntRouter/Loom/internal/protocol"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// routeBatch routes the count messages of a producer's BATCH frame. If each
+// router they are delivered to would hand all of them to the same consumer,
+// and it accepts batches, they are forwarded to it as one batch; otherwise
+// each is routed on its own, in order.
+func (r *Router) routeBatch(ctx context.Context, br *bufio.Reader, cfg Config, p *producerState, count uint64) error {
+	if !p.batches {
+		return errors.New("protocol: batch without the batch feature")
+	}
+	entries, err := protocol.ReadBatch(br, p.session.Hello.Version, count, cfg.MaxKeyBytes, cfg.MaxMessageBytes)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Header.HasUpload {
+			return errors.New("protocol: upload in a batch")
+		}
+	}
+
+	if targets := r.batchTargets(entries); targets != nil {
+		return r.forwardBatch(ctx, p, entries, targets)
+	}
+	for _, e := range entries {
+		// Entries may be larger than a chunk; split them as a producer would.
+		chunk := make([]byte, max(min(len(e.Payload), cfg.MaxChunkBytes), 1))
+		body := bufio.NewReader(&framedReader{r: bytes.NewReader(e.Payload), chunk: chunk, endCode: p.aborts})
+		if err := r.routeMessage(ctx, body, cfg, p, e.Header, origin{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchTarget is a router a batch is forwarded to whole, and the consumer
+// that takes it.
+type batchTarget struct {
+	r     *Router
+	c     *consumerState
+	parts []uint64 // partition of each entry
+}
+
+// batchTargets returns where to forward entries as a batch, or nil if some
+// router would split them between consumers or has none that accepts
+// batches.
+func (r *Router) batchTargets(entries []protocol.BatchEntry) []batchTarget {
+	var targets []batchTarget
+	for _, t := range r.targets() {
+		cfg := t.config()
+		bt := batchTarget{r: t, parts: make([]uint64, len(entries))}
+		for i := range entries {
+			part, c := t.route(&entries[i].Header, cfg)
+			if c == nil || !c.batches || (bt.c != nil && c != bt.c) {
+				return nil
+			}
+			bt.c, bt.parts[i] = c, part
+		}
+		targets = append(targets, bt)
+	}
+	return targets
+}
+
+// forwardBatch queues entries for each target's consumer as a single
+// message, which the consumer ACKs once, and waits for the ACKs as
+// routeMessage would.
+func (r *Router) forwardBatch(ctx context.Context, p *producerState, entries []protocol.BatchEntry, targets []batchTarget) error {
+	received := time.Now()
+	ctx, span := tracer().Start(ctx, "loom.receive_batch", trace.WithAttributes(
+		attribute.String("messaging.destination.name", r.room),
+		attribute.Int("loom.batch_messages", len(entries)),
+	))
+	defer span.End()
+
+	// Each message keeps its own trace, as routeMessage would give it: its
+	// receive span continues the producer's traceparent, which is rewritten
+	// for the consumer.
+	receives := make([]trace.Span, len(entries))
+	for i := range entries {
+		_, receives[i] = r.startReceiveSpan(ctx, &entries[i].Header)
+		receives[i].SetAttributes(attribute.Int64("loom.bytes", int64(len(entries[i].Payload))))
+	}
+	defer func() {
+		for _, s := range receives {
+			s.End()
+		}
+	}()
+
+	var total uint64
+	for _, e := range entries {
+		n := uint64(len(e.Payload))
+		total += n
+		metrics.MessagesIn.WithLabelValues(r.room).Inc()
+		metrics.MessageSize.WithLabelValues(r.room).Observe(float64(n))
+	}
+	p.messages.Add(uint64(len(entries)))
+	p.bytes.Add(total)
+	metrics.BytesIn.WithLabelValues(r.room).Add(float64(total))
+
+	var deliveries []*delivery
+	for _, bt := range targets {
+		msgID := bt.r.msgSeq.Add(1)
+		batch := make([]protocol.BatchEntry, len(entries))
+		for i, e := range entries {
+			// Every message carries the batch's id, which the consumer ACKs.
+			batch[i] = protocol.BatchEntry{
+				Header: protocol.MessageHeader{
+					Key:          e.Header.Key,
+					DeclaredSize: uint64(len(e.Payload)),
+					MsgID:        msgID,
+					Partition:    bt.parts[i],
+					HasPartition: true,
+					Headers:      e.Header.Headers,
+				},
+				Payload: e.Payload,
+			}
+		}
+		chunks := make(chan []byte)
+		close(chunks)
+		msg := &routedMessage{
+			key:       entries[0].Header.Key,
+			msgID:     msgID,
+			partition: bt.parts[0],
+			batch:     batch,
+			chunks:    chunks,
+			acked:     make(chan struct{}),
+			received:  received,
+			queued:    time.Now(),
+			spanCtx:   span.SpanContext(),
+		}
+		d, err := bt.r.queue(ctx, bt.r.config(), bt.c, msg)
+		if err != nil {
+			closeDeliveries(deliveries)
+			return err
+		}
+		if d != nil {
+			d.closed = true
+			deliveries = append(deliveries, d)
+		}
+	}
+	return waitAcked(ctx, deliveries)
+}
+
+// writeBatch writes the batch msg to c in one BATCH frame. It returns the
+// payload bytes written.
+func (r *Router) writeBatch(w *bufio.Writer, c *consumerState, msg *routedMessage) (uint64, error) {
+	if err := protocol.WriteBatch(w, c.version, msg.batch); err != nil {
+		return 0, fmt.Errorf("write batch: %w", err)
+	}
+	var sent uint64
+	for _, e := range msg.batch {
+		sent += uint64(len(e.Payload))
+	}
+	c.bytesSent.Add(sent)
+	metrics.BytesOut.WithLabelValues(r.room).Add(float64(sent))
+	return sent, nil
+}
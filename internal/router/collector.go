@@ -0,0 +1,79 @@
+package router
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherConsumers is the consumer label for consumers beyond the series limit.
+const otherConsumers = "_other"
+
+// consumerCollector reports per-consumer backlog and pending-ACK gauges at
+// scrape time, so series disappear with their consumers. At most maxSeries
+// consumers get their own series; the rest are summed per room under
+// consumer="_other".
+type consumerCollector struct {
+	rooms     *RoomManager
+	maxSeries int
+
+	backlog *prometheus.Desc
+	pending *prometheus.Desc
+}
+
+// ConsumerCollector returns a collector of per-consumer gauges limited to
+// maxSeries consumers.
+func (m *RoomManager) ConsumerCollector(maxSeries int) prometheus.Collector {
+	labels := []string{"room", "consumer", "name"}
+	return &consumerCollector{
+		rooms:     m,
+		maxSeries: maxSeries,
+		backlog:   prometheus.NewDesc("loom_consumer_backlog", "Messages queued for a consumer", labels, nil),
+		pending:   prometheus.NewDesc("loom_consumer_pending_acks", "Messages written to a consumer and awaiting ACK", labels, nil),
+	}
+}
+
+func (cc *consumerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.backlog
+	ch <- cc.pending
+}
+
+func (cc *consumerCollector) Collect(ch chan<- prometheus.Metric) {
+	series := 0
+	for _, room := range cc.rooms.Rooms() {
+		r, ok := cc.rooms.Lookup(room.Name)
+		if !ok {
+			continue
+		}
+		r.mu.RLock()
+		consumers := make([]*consumerState, 0, len(r.consumers))
+		for _, c := range r.consumers {
+			consumers = append(consumers, c)
+		}
+		r.mu.RUnlock()
+		sort.Slice(consumers, func(i, j int) bool { return consumers[i].id < consumers[j].id })
+
+		var otherBacklog, otherPending float64
+		overflow := false
+		for _, c := range consumers {
+			backlog := float64(len(c.send))
+			c.pmu.Lock()
+			pending := float64(len(c.pending))
+			c.pmu.Unlock()
+
+			if series >= cc.maxSeries {
+				otherBacklog += backlog
+				otherPending += pending
+				overflow = true
+				continue
+			}
+			series++
+			ch <- prometheus.MustNewConstMetric(cc.backlog, prometheus.GaugeValue, backlog, room.Name, c.id, c.name)
+			ch <- prometheus.MustNewConstMetric(cc.pending, prometheus.GaugeValue, pending, room.Name, c.id, c.name)
+		}
+		if overflow {
+			ch <- prometheus.MustNewConstMetric(cc.backlog, prometheus.GaugeValue, otherBacklog, room.Name, otherConsumers, "")
+			ch <- prometheus.MustNewConstMetric(cc.pending, prometheus.GaugeValue, otherPending, room.Name, otherConsumers, "")
+		}
+	}
+}
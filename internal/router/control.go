@@ -0,0 +1,128 @@
+package router
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrRoomPaused = errors.New("router: room paused")
+	errKicked     = errors.New("router: consumer kicked")
+)
+
+// Pause modes.
+const (
+	// PauseBlock holds producers at the next message boundary until resumed.
+	PauseBlock = "block"
+	// PauseReject closes producer streams at the next message boundary and
+	// refuses new ones.
+	PauseReject = "reject"
+)
+
+type pauseState struct {
+	mode    string
+	resumed chan struct{}
+}
+
+// Pause stops delivery in the room. Consumers finish the message they are
+// writing and then idle; producers are blocked or rejected depending on mode.
+// Pausing an already paused room only changes the mode.
+func (r *Router) Pause(mode string) error {
+	if mode != PauseBlock && mode != PauseReject {
+		return errors.New("router: unknown pause mode " + mode)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused != nil {
+		r.paused.mode = mode
+		return nil
+	}
+	r.paused = &pauseState{mode: mode, resumed: make(chan struct{})}
+	return nil
+}
+
+// Resume undoes Pause. It reports whether the room was paused.
+func (r *Router) Resume() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused == nil {
+		return false
+	}
+	close(r.paused.resumed)
+	r.paused = nil
+	return true
+}
+
+// PauseMode returns the current pause mode, or "" if the room is running.
+func (r *Router) PauseMode() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pauseModeLocked()
+}
+
+func (r *Router) pauseModeLocked() string {
+	if r.paused == nil {
+		return ""
+	}
+	return r.paused.mode
+}
+
+// waitRunning blocks while the room is paused, until done or ctx ends.
+// Producers get ErrRoomPaused instead of blocking in reject mode.
+func (r *Router) waitRunning(ctx context.Context, done <-chan struct{}, producer bool) error {
+	for {
+		r.mu.RLock()
+		p := r.paused
+		r.mu.RUnlock()
+		if p == nil {
+			return nil
+		}
+		if producer && p.mode == PauseReject {
+			return ErrRoomPaused
+		}
+		select {
+		case <-p.resumed:
+		case <-done:
+			return context.Canceled
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// KickConsumer disconnects the consumer with the given id. Its in-progress
+// message is abandoned and queued messages are released to their producers.
+func (r *Router) KickConsumer(id string) bool {
+	r.mu.RLock()
+	c := r.consumers[id]
+	r.mu.RUnlock()
+	if c == nil {
+		return false
+	}
+	c.active.Store(false)
+	c.kickOnce.Do(func() { close(c.kicked) })
+	return true
+}
+
+// PurgeConsumer discards the messages queued for a consumer but not yet
+// being written. It returns the number of messages purged.
+func (r *Router) PurgeConsumer(id string) (int, bool) {
+	r.mu.RLock()
+	c := r.consumers[id]
+	r.mu.RUnlock()
+	if c == nil {
+		return 0, false
+	}
+	n := 0
+	for {
+		select {
+		case msg := <-c.send:
+			msg.canceled.Store(true)
+			msg.markAcked(false)
+			r.recordDrops(dropPurged, msg.count())
+			n++
+		default:
+			return n, true
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/metrics"
+	"github.com/BurntRouter/Loom/internal/protocol"
+)
+
+// datagramQueue bounds the datagrams a producer session holds before
+// routing them; more are dropped.
+const datagramQueue = 64
+
+// datagramSender sends datagrams on a QUIC connection.
+type datagramSender interface {
+	SendDatagram(b []byte) error
+}
+
+// datagramReceiver receives datagrams on a QUIC connection.
+type datagramReceiver interface {
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// datagramConn carries the datagrams of every session on one connection.
+// Received datagrams are handed to the producer session on the stream they
+// name.
+type datagramConn struct {
+	conn datagramSender
+
+	mu        sync.Mutex
+	producers map[uint64]func([]byte)
+}
+
+func newDatagramConn(conn datagramSender) *datagramConn {
+	return &datagramConn{conn: conn, producers: make(map[uint64]func([]byte))}
+}
+
+// register routes datagrams naming streamID to handle until the returned
+// function is called. handle runs on the connection's receive loop and
+// must not block.
+func (d *datagramConn) register(streamID uint64, handle func([]byte)) func() {
+	d.mu.Lock()
+	d.producers[streamID] = handle
+	d.mu.Unlock()
+	return func() {
+		d.mu.Lock()
+		delete(d.producers, streamID)
+		d.mu.Unlock()
+	}
+}
+
+// receive dispatches datagrams from conn until it is closed. Datagrams
+// naming no producer session are dropped.
+func (d *datagramConn) receive(ctx context.Context, conn datagramReceiver) {
+	for {
+		b, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		id, rest, err := protocol.DatagramStreamID(b)
+		if err != nil {
+			continue
+		}
+		d.mu.Lock()
+		handle := d.producers[id]
+		d.mu.Unlock()
+		if handle != nil {
+			handle(rest)
+		}
+	}
+}
+
+// receiveDatagrams routes the datagrams p sends until the returned function
+// is called.
+func (r *Router) receiveDatagrams(ctx context.Context, p *producerState) func() {
+	queue := make(chan []byte, datagramQueue)
+	done := make(chan struct{})
+	unregister := p.session.datagrams.register(p.session.streamID, func(b []byte) {
+		select {
+		case queue <- b:
+		default:
+			r.recordDrop(dropDatagramOverflow)
+		}
+	})
+	go func() {
+		for {
+			select {
+			case b := <-queue:
+				r.routeDatagram(ctx, p, b)
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		unregister()
+		close(done)
+	}
+}
+
+// routeDatagram routes a message p sent as a datagram. It is delivered like
+// any other, except that nothing waits for it: datagrams are best effort.
+func (r *Router) routeDatagram(ctx context.Context, p *producerState, b []byte) {
+	if err := r.waitRunning(ctx, r.draining(), true); err != nil {
+		r.recordDrop(dropPaused)
+		return
+	}
+	cfg := r.config()
+	hdr, payload, err := protocol.ReadDatagramMessage(b, p.session.Hello.Version, cfg.MaxKeyBytes)
+	if err != nil {
+		p.session.logger().Debug("loom: bad datagram", logging.KeyErr, err)
+		return
+	}
+	if len(payload) > cfg.DatagramMaxBytes {
+		r.recordDrop(dropTooLarge)
+		return
+	}
+	body := bufio.NewReader(&framedReader{r: bytes.NewReader(payload), chunk: make([]byte, max(len(payload), 1)), endCode: p.aborts})
+	if err := r.routeMessage(ctx, body, cfg, p, hdr, origin{lossy: true}); err != nil {
+		p.session.logger().Debug("loom: routing datagram failed", logging.KeyErr, err)
+	}
+}
+
+// sendDatagram delivers msg to c as a datagram. If it cannot, as when it is
+// too large for one, it returns a copy of msg to write to c's stream
+// instead; otherwise nil.
+func (r *Router) sendDatagram(c *consumerState, msg *routedMessage) *routedMessage {
+	if ok, _ := r.admit(c, msg); !ok {
+		return nil
+	}
+	var payload []byte
+	for chunk := range msg.chunks {
+		payload = append(payload, chunk...)
+	}
+	if msg.aborted.Load() {
+		msg.markAcked(false)
+		return nil
+	}
+	b, err := protocol.AppendDatagram(nil, c.session.streamID, c.version, msg.header(), payload)
+	if err == nil {
+		err = c.session.datagrams.conn.SendDatagram(b)
+	}
+	if err != nil {
+		c.log.Debug("loom: sending datagram failed", logging.KeyMsgID, msg.msgID, logging.KeyErr, err)
+		return fallbackMessage(msg, payload)
+	}
+	msg.markAcked(true)
+	c.heard()
+	c.messagesSent.Add(1)
+	c.bytesSent.Add(uint64(len(payload)))
+	metrics.MessagesOut.WithLabelValues(r.room).Inc()
+	metrics.BytesOut.WithLabelValues(r.room).Add(float64(len(payload)))
+	return nil
+}
+
+// fallbackMessage returns a message carrying the payload msg was read into,
+// to deliver it on a stream after all. msg itself is resolved: the copy
+// stands in for it from then on.
+func fallbackMessage(msg *routedMessage, payload []byte) *routedMessage {
+	chunks := make(chan []byte, 1)
+	if len(payload) > 0 {
+		chunks <- payload
+	}
+	close(chunks)
+	msg.markAcked(true)
+	return &routedMessage{
+		key:          msg.key,
+		declaredSize: msg.declaredSize,
+		msgID:        msg.msgID,
+		partition:    msg.partition,
+		headers:      msg.headers,
+		chunks:       chunks,
+		lossy:        true,
+		received:     msg.received,
+		queued:       msg.queued,
+		spanCtx:      msg.spanCtx,
+		acked:        make(chan struct{}),
+	}
+}
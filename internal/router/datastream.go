@@ -0,0 +1,107 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Data streams granted to a protocol.FeatureStreams consumer that does not
+// ask for a number, and the most it may ask for.
+const (
+	defaultDataStreams = 4
+	maxDataStreams     = 16
+)
+
+// dataStream is a unidirectional stream carrying one message to a consumer.
+type dataStream interface {
+	io.WriteCloser
+	// Cancel resets the stream, so the consumer does not mistake a
+	// partial message for a complete one.
+	Cancel()
+}
+
+// streamOpener opens data streams on a consumer's connection.
+type streamOpener interface {
+	OpenDataStream(ctx context.Context) (dataStream, error)
+}
+
+// dataStreams returns how many data streams may be open to the consumer
+// behind sess at once, or zero if it receives messages on its own stream.
+func (r *Router) dataStreams(sess Session) int {
+	if sess.Hello.Role != protocol.RoleConsumer || r.features(sess)&protocol.FeatureStreams == 0 {
+		return 0
+	}
+	n := sess.Hello.DataStreams
+	if n == 0 {
+		n = defaultDataStreams
+	}
+	return int(min(n, maxDataStreams))
+}
+
+// slotFree reports whether c may open another data stream. Only c's writer
+// takes slots, so a free slot stays free until it does.
+func (c *consumerState) slotFree() bool {
+	return len(c.slots) < cap(c.slots)
+}
+
+// deliverOnStream writes msg to c on a data stream of its own, so a large
+// message does not hold up the ones behind it. The caller has taken a slot,
+// which is given back once the stream ends. A failed stream gives up its
+// message without closing c.
+func (r *Router) deliverOnStream(c *consumerState, msg *routedMessage, chunkWrite prometheus.Observer) {
+	defer func() {
+		<-c.slots
+		c.signal()
+	}()
+	if ok, _ := r.admit(c, msg); !ok {
+		return
+	}
+	s, err := c.session.streams.OpenDataStream(c.stream.Context())
+	if err != nil {
+		c.log.Warn("loom: opening data stream failed", logging.KeyMsgID, msg.msgID, logging.KeyErr, err)
+		r.abandon(c, msg)
+		return
+	}
+	// Reset the stream if c goes away while the message is being written.
+	stop := context.AfterFunc(c.stream.Context(), s.Cancel)
+	defer stop()
+
+	w := bufio.NewWriter(s)
+	err = protocol.WriteDataStreamHeader(w, c.id)
+	if err == nil {
+		err = r.transmit(w, c, msg, chunkWrite)
+	}
+	if err == nil {
+		err = s.Close()
+	}
+	if err != nil {
+		s.Cancel()
+		c.log.Warn("loom: data stream write failed", logging.KeyMsgID, msg.msgID, logging.KeyErr, err)
+		r.abandon(c, msg)
+	}
+}
+
+// abandon gives up msg after its data stream failed. A message c could
+// resume is retained for it.
+func (r *Router) abandon(c *consumerState, msg *routedMessage) {
+	c.pmu.Lock()
+	if c.pending[msg.msgID] == msg {
+		delete(c.pending, msg.msgID)
+	}
+	c.pmu.Unlock()
+	if c.resumes {
+		r.retain(c, msg)
+	}
+	msg.canceled.Store(true)
+	if msg.markAcked(false) {
+		r.recordDrops(dropConsumerGone, msg.count())
+	}
+	if msg.await != nil {
+		endSpan(msg.await, errConsumerClosed)
+	}
+}
@@ -0,0 +1,195 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/protocol"
+)
+
+var ErrDraining = errors.New("router: server draining")
+
+// drainPollInterval is how often WaitDrained checks for in-flight messages.
+const drainPollInterval = 50 * time.Millisecond
+
+// Drain starts the shutdown drain: new streams are refused, producers are
+// sent GOAWAY and closed at their next message boundary, and consumers keep
+// running until their backlog is delivered. timeout is the hint sent to
+// producers. Calling Drain again has no effect.
+func (m *RoomManager) Drain(timeout time.Duration) {
+	m.drainOnce.Do(func() {
+		m.drainDeadline = time.Now().Add(timeout)
+		close(m.drain)
+	})
+}
+
+// Draining reports whether Drain has been called.
+func (m *RoomManager) Draining() bool {
+	select {
+	case <-m.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitDrained blocks until no producer is connected and every consumer has
+// written and had ACKed its backlog, or ctx is done. It reports whether the
+// drain completed.
+func (m *RoomManager) WaitDrained(ctx context.Context) bool {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for m.inFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+		}
+	}
+	return true
+}
+
+// inFlight counts connected producers plus messages queued for or awaiting
+// ACK from consumers, across all rooms.
+func (m *RoomManager) inFlight() int {
+	m.mu.RLock()
+	routers := make([]*Router, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		routers = append(routers, r)
+	}
+	m.mu.RUnlock()
+
+	n := 0
+	for _, r := range routers {
+		r.mu.RLock()
+		n += len(r.producers)
+		for _, c := range r.consumers {
+			n += len(c.send)
+			c.pmu.Lock()
+			n += len(c.pending)
+			c.pmu.Unlock()
+		}
+		r.mu.RUnlock()
+	}
+	return n
+}
+
+// sendGoAway writes a GOAWAY frame to a v5 producer once the manager starts
+// draining. It returns when the frame is sent or stop is closed.
+func (m *RoomManager) sendGoAway(w io.Writer, version byte, stop <-chan struct{}) {
+	if version < protocol.Version5 {
+		return
+	}
+	select {
+	case <-stop:
+		return
+	case <-m.drain:
+	}
+	remaining := time.Until(m.drainDeadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	_ = protocol.WriteGoAway(bufio.NewWriter(w), uint64(remaining.Milliseconds()))
+}
+
+// draining returns the manager's drain channel, or nil for a standalone
+// router.
+func (r *Router) draining() <-chan struct{} {
+	if r.rooms == nil {
+		return nil
+	}
+	return r.rooms.drain
+}
+
+// boundaryWatcher waits for a producer's next message on behalf of
+// nextMessage, so a drain or idle timeout can end the wait. One goroutine
+// and one timer serve every message boundary of the stream; both are only
+// created once a wait needs them.
+type boundaryWatcher struct {
+	br     *bufio.Reader
+	peek   chan struct{}
+	peeked chan error
+	done   chan struct{}
+	timer  *time.Timer
+}
+
+func newBoundaryWatcher(br *bufio.Reader) *boundaryWatcher {
+	return &boundaryWatcher{br: br, done: make(chan struct{})}
+}
+
+// start begins a peek at the next byte of the stream, whose result arrives
+// on w.peeked. The peek outlives a wait abandoned on drain or idle timeout;
+// the caller closes the stream, which ends it.
+func (w *boundaryWatcher) start() {
+	if w.peek == nil {
+		w.peek = make(chan struct{})
+		w.peeked = make(chan error, 1)
+		go func() {
+			for {
+				select {
+				case <-w.peek:
+				case <-w.done:
+					return
+				}
+				_, err := w.br.Peek(1)
+				w.peeked <- err
+			}
+		}()
+	}
+	w.peek <- struct{}{}
+}
+
+// idle returns a channel that fires after d, or nil if d is zero.
+func (w *boundaryWatcher) idle(d time.Duration) <-chan time.Time {
+	if d == 0 {
+		return nil
+	}
+	if w.timer == nil {
+		w.timer = time.NewTimer(d)
+	} else {
+		w.timer.Reset(d)
+	}
+	return w.timer.C
+}
+
+// stop releases the watcher's goroutine and timer.
+func (w *boundaryWatcher) stop() {
+	close(w.done)
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// nextMessage waits until the producer starts another message. It reports
+// false if the server began draining while the producer was between
+// messages, or the producer closed the stream, and fails with errIdle if
+// idle is set and the producer sends nothing for that long.
+func (r *Router) nextMessage(ctx context.Context, w *boundaryWatcher, idle time.Duration) (bool, error) {
+	drain := r.draining()
+	select {
+	case <-drain:
+		return false, nil
+	default:
+	}
+	if (drain == nil && idle == 0) || w.br.Buffered() > 0 {
+		return true, nil
+	}
+	timeout := w.idle(idle)
+	w.start()
+	select {
+	case err := <-w.peeked:
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return err == nil, err
+	case <-drain:
+		return false, nil
+	case <-timeout:
+		return false, errIdle
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
@@ -1,8 +1,13 @@
 package router
 
 import (
+	"errors"
+	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/BurntRouter/Loom/internal/metrics"
+	"github.com/BurntRouter/Loom/internal/protocol"
 )
 
 // ProducerErrorTracker tracks protocol errors per producer to detect misbehaving clients
@@ -92,6 +97,54 @@ func (t *ProducerErrorTracker) IsBlocked(producerKey string) bool {
 	return state.blocked
 }
 
+// BlockedProducer describes a producer currently blocked by the tracker.
+type BlockedProducer struct {
+	Key       string    `json:"key"`
+	Errors    int       `json:"errors"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Blocked lists the producers that are currently blocked.
+func (t *ProducerErrorTracker) Blocked() []BlockedProducer {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var out []BlockedProducer
+	for key, state := range t.errors {
+		if state.blocked && time.Since(state.firstSeen) <= t.window {
+			out = append(out, BlockedProducer{
+				Key:       key,
+				Errors:    state.count,
+				FirstSeen: state.firstSeen,
+				LastSeen:  state.lastSeen,
+			})
+		}
+	}
+	return out
+}
+
+// Unblock forgets the error history of a producer. Returns true if it was blocked.
+func (t *ProducerErrorTracker) Unblock(producerKey string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, exists := t.errors[producerKey]
+	if !exists {
+		return false
+	}
+	delete(t.errors, producerKey)
+	return state.blocked
+}
+
 // Cleanup removes old entries
 func (t *ProducerErrorTracker) Cleanup() {
 	if t == nil {
@@ -108,3 +161,46 @@ func (t *ProducerErrorTracker) Cleanup() {
 		}
 	}
 }
+
+// producerBlocked reports whether the producer behind key is blocked after
+// repeated protocol errors, counting the rejection.
+func (m *RoomManager) producerBlocked(room, key string, logger *slog.Logger) bool {
+	if m.errorTracker == nil || !m.errorTracker.IsBlocked(key) {
+		return false
+	}
+	logger.Warn("loom: rejecting blocked producer")
+	metrics.BlockedProducers.WithLabelValues(room).Inc()
+	return true
+}
+
+// recordProducerError counts err against the producer behind key if it is a
+// protocol error (likely a client bug), blocking it after repeated ones.
+func (m *RoomManager) recordProducerError(room, key string, err error, logger *slog.Logger) {
+	errMsg := err.Error()
+	isProtocolError := errors.Is(err, protocol.ErrBadHandshake) ||
+		errMsg == "protocol: empty key - possible stream corruption" ||
+		(len(errMsg) > 9 && errMsg[:9] == "protocol:")
+	if !isProtocolError {
+		return
+	}
+
+	// Categorize error type for metrics
+	errorType := "unknown"
+	if errMsg == "protocol: empty key - possible stream corruption" {
+		errorType = "empty_key"
+	} else if len(errMsg) > 20 && errMsg[:20] == "protocol: chunk too" {
+		errorType = "chunk_too_large"
+	} else if len(errMsg) > 19 && errMsg[:19] == "protocol: key too" {
+		errorType = "key_too_large"
+	} else if len(errMsg) > 25 && errMsg[:25] == "protocol: invalid varint" {
+		errorType = "invalid_varint"
+	}
+	metrics.ProtocolErrors.WithLabelValues(room, errorType).Inc()
+
+	if m.errorTracker != nil {
+		if blocked := m.errorTracker.RecordError(key); blocked {
+			metrics.BlockedProducers.WithLabelValues(room).Inc()
+			logger.Warn("loom: blocked producer after repeated protocol errors")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"bytes"
+
+	"github.com/BurntRouter/Loom/internal/protocol"
+)
+
+// consumerFilter is the compiled form of a consumer's protocol.Filter.
+type consumerFilter struct {
+	partitions map[uint64]struct{}
+	keyPrefix  []byte
+	headers    []protocol.HeaderField
+}
+
+func newConsumerFilter(f protocol.Filter) consumerFilter {
+	cf := consumerFilter{
+		keyPrefix: f.KeyPrefix,
+		headers:   f.Headers,
+	}
+	if len(f.Partitions) > 0 {
+		cf.partitions = make(map[uint64]struct{}, len(f.Partitions))
+		for _, p := range f.Partitions {
+			cf.partitions[p] = struct{}{}
+		}
+	}
+	return cf
+}
+
+// admitsPartition reports whether the partition filter, if any, allows part.
+func (f *consumerFilter) admitsPartition(part uint64) bool {
+	if f.partitions == nil {
+		return true
+	}
+	_, ok := f.partitions[part]
+	return ok
+}
+
+// matches reports whether a message in partition part with header hdr passes
+// the filter. All configured conditions must hold.
+func (f *consumerFilter) matches(part uint64, hdr *protocol.MessageHeader) bool {
+	if !f.admitsPartition(part) {
+		return false
+	}
+	if len(f.keyPrefix) > 0 && !bytes.HasPrefix(hdr.Key, f.keyPrefix) {
+		return false
+	}
+	for _, want := range f.headers {
+		if v, ok := hdr.Header(want.Name); !ok || v != want.Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"errors"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/metrics"
+)
+
+// errConsumerClosed ends the await span of messages still pending when a
+// consumer goes away.
+var errConsumerClosed = errors.New("router: consumer closed before ACK")
+
+// The delivery window bounds what a consumer has been sent but not yet
+// ACKed. Consumers without protocol.FeatureCredit, and credit consumers
+// until their first CREDIT frame, get one message at a time, or one per
+// data stream with protocol.FeatureStreams.
+const defaultCreditMessages = 1
+
+// setCredit replaces c's delivery window. The message window is capped at
+// the backlog depth; a byte window of zero leaves bytes unbounded.
+func (r *Router) setCredit(c *consumerState, messages, bytes uint64) {
+	if limit := uint64(r.config().ConsumerQueueDepth); limit > 0 && messages > limit {
+		messages = limit
+	}
+	c.creditMessages.Store(messages)
+	c.creditBytes.Store(bytes)
+	c.signal()
+}
+
+// signal wakes c's writer to re-check its window.
+func (c *consumerState) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch counts msg against c's window as it is handed to a data stream,
+// before its stream is open, at its declared size until it has been
+// written. The window releases it once it is ACKed or given up.
+func (c *consumerState) dispatch(msg *routedMessage) {
+	c.pmu.Lock()
+	msg.sent = msg.declaredSize
+	c.addPending(msg)
+	c.pmu.Unlock()
+}
+
+// addPending counts msg against c's window until it is resolved, which
+// wakes c's writer however it happens. c.pmu must be held.
+func (c *consumerState) addPending(msg *routedMessage) {
+	c.pending[msg.msgID] = msg
+	msg.window.Store(c)
+}
+
+// settle forgets pending messages that were resolved without an ACK from c,
+// and reports whether the window has room for another message. When it has
+// not, the writer is signaled once one of the pending messages resolves.
+func (c *consumerState) settle() bool {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	var n, bytes uint64
+	for id, m := range c.pending {
+		select {
+		case <-m.acked:
+			if m.await != nil {
+				m.await.End()
+			}
+			delete(c.pending, id)
+			continue
+		default:
+		}
+		n++
+		bytes += m.sent
+	}
+	if n >= c.creditMessages.Load() {
+		return false
+	}
+	if limit := c.creditBytes.Load(); limit > 0 && bytes >= limit {
+		return false
+	}
+	return true
+}
+
+// ack resolves the pending message msgID after the consumer ACKed it.
+func (r *Router) ack(c *consumerState, msgID uint64) {
+	c.pmu.Lock()
+	m := c.pending[msgID]
+	delete(c.pending, msgID)
+	c.pmu.Unlock()
+	if m == nil {
+		return
+	}
+	if m.markAcked(true) {
+		metrics.MessageLatency.WithLabelValues(r.room).Observe(time.Since(m.received).Seconds())
+	}
+	if m.await != nil {
+		m.await.End()
+	}
+}
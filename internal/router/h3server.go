@@ -6,11 +6,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 
 	"github.com/BurntRouter/Loom/internal/auth"
 	"github.com/BurntRouter/Loom/internal/config"
+	"github.com/BurntRouter/Loom/internal/logging"
 	"github.com/BurntRouter/Loom/internal/metrics"
 	"github.com/BurntRouter/Loom/internal/protocol"
 	"github.com/quic-go/quic-go/http3"
@@ -22,6 +24,8 @@ type H3Server struct {
 
 	Rooms *RoomManager
 	Auth  *AuthContext
+
+	listenState
 }
 
 func (s *H3Server) ListenAndServe(ctx context.Context) error {
@@ -36,13 +40,19 @@ func (s *H3Server) ListenAndServe(ctx context.Context) error {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
+		if s.Rooms.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
 		br := bufio.NewReader(r.Body)
-		role, name, room, token, err := protocol.ReadHello(br, s.Rooms.cfg.MaxNameBytes, s.Rooms.cfg.MaxRoomBytes, s.Rooms.cfg.MaxTokenBytes)
+		base := s.Rooms.config()
+		hello, err := protocol.ReadHello(br, base.MaxNameBytes, base.MaxRoomBytes, base.MaxTokenBytes)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			rejectHTTP(w, errorCode(err), err.Error())
 			return
 		}
+		role, room, token := hello.Role, hello.Room, hello.Token
 
 		var roleEnum auth.Role
 		var roleLabel string
@@ -54,7 +64,11 @@ func (s *H3Server) ListenAndServe(ctx context.Context) error {
 			roleEnum = auth.RoleConsume
 			roleLabel = "consumer"
 		default:
-			w.WriteHeader(http.StatusBadRequest)
+			rejectHTTP(w, protocol.ErrorBadHandshake, "unknown role")
+			return
+		}
+		if !validRoom(role, room) {
+			rejectHTTP(w, protocol.ErrorBadHandshake, "invalid room")
 			return
 		}
 
@@ -63,23 +77,74 @@ func (s *H3Server) ListenAndServe(ctx context.Context) error {
 			authCtx = &AuthContext{Mode: config.AuthModeDisabled}
 		}
 		d := authCtx.authorizeHTTP(r, token, room, roleEnum)
+		recordDecision(d, room, roleEnum, r.RemoteAddr, "h3")
 		if !d.Allowed {
-			w.WriteHeader(http.StatusUnauthorized)
+			rejectHTTP(w, decisionCode(d), d.Reason)
 			return
 		}
 
 		metrics.Streams.WithLabelValues("h3", roleLabel, room).Inc()
 		defer metrics.Streams.WithLabelValues("h3", roleLabel, room).Dec()
 
-		roomRouter := s.Rooms.Get(room)
+		sess := Session{Hello: hello, Principal: d.Principal, RemoteAddr: r.RemoteAddr, Transport: "h3"}
+		logger := sess.logger()
+		roomRouter, err := s.Rooms.Get(room)
+		if err != nil {
+			logger.Warn("loom: rejecting stream", logging.KeyErr, err)
+			rejectHTTP(w, errorCode(err), err.Error())
+			return
+		}
 		switch role {
 		case protocol.RoleProducer:
-			if err := roomRouter.HandleProducer(r.Context(), br); err != nil {
-				log.Printf("loom: h3 producer error room=%q: %v", room, err)
-				w.WriteHeader(http.StatusBadRequest)
+			producerKey := room + ":" + hello.Name + ":" + r.RemoteAddr
+			if s.Rooms.producerBlocked(room, producerKey, logger) {
+				rejectHTTP(w, protocol.ErrorBlocked, "too many protocol errors")
 				return
 			}
-			w.WriteHeader(http.StatusOK)
+
+			// v6 producers get the server Hello up front, so later
+			// failures are reported in an ERROR frame, not the status.
+			v6 := hello.Version >= protocol.Version6
+			out := &httpResponseWriteStream{w: w, ctx: r.Context()}
+			stop := make(chan struct{})
+			controlDone := make(chan struct{})
+			if v6 {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.WriteHeader(http.StatusOK)
+				if err := roomRouter.writeServerHello(out, sess, ""); err != nil {
+					return
+				}
+				sess.uploadStatus, sess.controlDone = make(chan protocol.UploadStatus), controlDone
+				go func() {
+					defer close(controlDone)
+					roomRouter.runProducerControl(out, sess, stop)
+				}()
+			} else {
+				close(controlDone)
+			}
+			err := roomRouter.HandleProducer(r.Context(), sess, br)
+			close(stop)
+			<-controlDone
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					s.Rooms.recordProducerError(room, producerKey, err, logger)
+				}
+				logger.Warn("loom: producer stream error", logging.KeyErr, err)
+				switch {
+				case v6:
+					if errors.Is(err, ErrRoomPaused) || errors.Is(err, ErrRoomClosed) {
+						_ = protocol.WriteError(bufio.NewWriter(out), errorCode(err), err.Error())
+					}
+				case errors.Is(err, ErrRoomPaused), errors.Is(err, ErrRoomClosed):
+					rejectHTTP(w, errorCode(err), err.Error())
+				default:
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				return
+			}
+			if !v6 {
+				w.WriteHeader(http.StatusOK)
+			}
 		case protocol.RoleConsumer:
 			w.Header().Set("Content-Type", "application/octet-stream")
 			w.WriteHeader(http.StatusOK)
@@ -87,13 +152,21 @@ func (s *H3Server) ListenAndServe(ctx context.Context) error {
 				f.Flush()
 			}
 
-			ws := &httpBidiStream{r: br, body: r.Body, w: w, ctx: r.Context()}
-			id, err := roomRouter.RegisterConsumer(name, ws)
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			ws := &httpBidiStream{r: br, body: r.Body, w: w, ctx: ctx, cancel: cancel}
+			id, err := roomRouter.RegisterConsumer(sess, ws)
 			if err != nil {
+				// The status is already sent; v6 consumers expect an ERROR
+				// frame in place of the SERVER_HELLO.
+				logger.Warn("loom: rejecting consumer", logging.KeyErr, err)
+				if hello.Version >= protocol.Version6 {
+					_ = protocol.WriteError(bufio.NewWriter(w), errorCode(err), err.Error())
+				}
 				return
 			}
-			log.Printf("loom: h3 consumer connected room=%q id=%s name=%q", room, id, name)
-			<-r.Context().Done()
+			logger.Info("loom: consumer connected", logging.KeyConsumerID, id)
+			<-ctx.Done()
 		default:
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -106,19 +179,28 @@ func (s *H3Server) ListenAndServe(ctx context.Context) error {
 	}
 	defer srv.Close()
 
-	log.Printf("loom: http3 listening on %s", s.Addr)
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s.setListening(true)
+	defer s.setListening(false)
+
+	slog.Info("loom: listening", "addr", s.Addr, logging.KeyTransport, "h3")
 	go func() {
 		<-ctx.Done()
 		_ = srv.Close()
 	}()
-	return srv.ListenAndServe()
+	return srv.Serve(conn)
 }
 
 type httpBidiStream struct {
-	r    *bufio.Reader
-	body io.ReadCloser
-	w    http.ResponseWriter
-	ctx  context.Context
+	r      *bufio.Reader
+	body   io.ReadCloser
+	w      http.ResponseWriter
+	ctx    context.Context
+	cancel context.CancelFunc // ends the request so the handler returns
 }
 
 func (h *httpBidiStream) Read(p []byte) (int, error) { return h.r.Read(p) }
@@ -129,7 +211,10 @@ func (h *httpBidiStream) Write(p []byte) (int, error) {
 	}
 	return n, err
 }
-func (h *httpBidiStream) Close() error             { return h.body.Close() }
+func (h *httpBidiStream) Close() error {
+	h.cancel()
+	return h.body.Close()
+}
 func (h *httpBidiStream) Context() context.Context { return h.ctx }
 
 type httpResponseWriteStream struct {
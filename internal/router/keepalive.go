@@ -0,0 +1,90 @@
+package router
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/protocol"
+)
+
+// errIdle ends a stream whose client stopped answering PINGs.
+var errIdle = errors.New("router: stream idle")
+
+// pingTicker ticks at the ping interval, or never when pings are off.
+type pingTicker struct {
+	t *time.Ticker
+}
+
+func (r *Router) pingTicker(enabled bool) pingTicker {
+	interval := r.config().PingInterval
+	if !enabled || interval <= 0 {
+		return pingTicker{}
+	}
+	return pingTicker{t: time.NewTicker(interval)}
+}
+
+// C returns the tick channel, which is nil when pings are off.
+func (p pingTicker) C() <-chan time.Time {
+	if p.t == nil {
+		return nil
+	}
+	return p.t.C
+}
+
+func (p pingTicker) Stop() {
+	if p.t != nil {
+		p.t.Stop()
+	}
+}
+
+// heard records that the consumer is alive. The writer also calls it after
+// each message, so time spent writing to a slow reader is not held against
+// it.
+func (c *consumerState) heard() {
+	c.lastHeard.Store(time.Now().UnixNano())
+}
+
+// pingConsumer sends c a PING, or fails with errIdle if c has been silent
+// for longer than the idle timeout. It is called only between messages.
+func (r *Router) pingConsumer(w *bufio.Writer, c *consumerState) error {
+	idle := r.config().IdleTimeout
+	if silent := time.Since(time.Unix(0, c.lastHeard.Load())); idle > 0 && silent > idle {
+		return fmt.Errorf("%w for %s", errIdle, silent.Round(time.Second))
+	}
+	return protocol.WriteControlFrame(w, protocol.FramePing, uint64(time.Now().UnixMilli()))
+}
+
+// runProducerControl writes server frames to a producer stream until stop is
+// closed: a PING every ping interval if the producer negotiated pings, a
+// GOAWAY once the server starts draining, and upload statuses queued by
+// HandleProducer.
+func (r *Router) runProducerControl(w io.Writer, sess Session, stop <-chan struct{}) {
+	ping := r.pingTicker(r.features(sess)&protocol.FeaturePing != 0)
+	defer ping.Stop()
+	pings, drain := ping.C(), r.draining()
+	bw := bufio.NewWriter(w)
+	for {
+		var err error
+		select {
+		case <-stop:
+			return
+		case <-drain:
+			// Pings stop once the server drains; the producer is closed at
+			// its next message boundary.
+			pings, drain = nil, nil
+			if r.rooms != nil {
+				r.rooms.sendGoAway(w, sess.Hello.Version, stop)
+			}
+		case <-pings:
+			err = protocol.WriteFrame(bw, protocol.FramePing, uint64(time.Now().UnixMilli()))
+		case st := <-sess.uploadStatus:
+			err = protocol.WriteUploadStatus(bw, st)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/BurntRouter/Loom/internal/auth"
+	"github.com/BurntRouter/Loom/internal/protocol"
+	quic "github.com/quic-go/quic-go"
+)
+
+// rejectQUIC ends a stream the server refused. Clients that read frames from
+// the server at that point — v5 producers and every v6 stream — first get an
+// ERROR frame; every stream is then reset with code as the QUIC application
+// error code.
+func rejectQUIC(stream *quic.Stream, hello protocol.Hello, code protocol.ErrorCode, msg string) {
+	qcode := quic.StreamErrorCode(code)
+	if expectsErrorFrame(hello) {
+		_ = protocol.WriteError(bufio.NewWriter(stream), code, msg)
+		_ = stream.Close()
+	} else {
+		stream.CancelWrite(qcode)
+	}
+	stream.CancelRead(qcode)
+}
+
+func expectsErrorFrame(hello protocol.Hello) bool {
+	return hello.Version >= protocol.Version6 ||
+		(hello.Role == protocol.RoleProducer && hello.Version >= protocol.Version5)
+}
+
+type rejectBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+// rejectHTTP answers a refused HTTP/3 stream with the status matching code
+// and a JSON body naming it.
+func rejectHTTP(w http.ResponseWriter, code protocol.ErrorCode, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(code))
+	_ = json.NewEncoder(w).Encode(rejectBody{Code: code.String(), Message: msg, Retryable: code.Retryable()})
+}
+
+func httpStatus(code protocol.ErrorCode) int {
+	switch code {
+	case protocol.ErrorUnauthorized:
+		return http.StatusUnauthorized
+	case protocol.ErrorForbiddenRoom:
+		return http.StatusForbidden
+	case protocol.ErrorBlocked:
+		return http.StatusTooManyRequests
+	case protocol.ErrorRoomPaused, protocol.ErrorRoomClosed:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// errorCode maps an error from reading a Hello or opening a room to the code
+// reported to the client.
+func errorCode(err error) protocol.ErrorCode {
+	switch {
+	case errors.Is(err, protocol.ErrUnsupportedVersion):
+		return protocol.ErrorUnsupportedVersion
+	case errors.Is(err, ErrRoomPaused):
+		return protocol.ErrorRoomPaused
+	case errors.Is(err, ErrRoomClosed):
+		return protocol.ErrorRoomClosed
+	case errors.Is(err, ErrUnknownRoom), errors.Is(err, ErrTooManyRooms):
+		return protocol.ErrorForbiddenRoom
+	default:
+		return protocol.ErrorBadHandshake
+	}
+}
+
+// decisionCode maps a denied auth decision to the code reported to the
+// client.
+func decisionCode(d auth.Decision) protocol.ErrorCode {
+	if d.Reason == "room not allowed" {
+		return protocol.ErrorForbiddenRoom
+	}
+	return protocol.ErrorUnauthorized
+}
@@ -0,0 +1,222 @@
+package router
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/protocol"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// diskMessage is a complete message payload in the staging area, shared by
+// every delivery of it. The file is deleted once the last reference is
+// released.
+type diskMessage struct {
+	path string
+	size uint64
+	refs atomic.Int64
+	done func() // called once the file is deleted
+}
+
+func newDiskMessage(path string, size uint64, done func()) *diskMessage {
+	d := &diskMessage{path: path, size: size, done: done}
+	d.refs.Store(1)
+	return d
+}
+
+// acquire takes a reference, unless the file is already gone.
+func (d *diskMessage) acquire() bool {
+	for {
+		n := d.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if d.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (d *diskMessage) release() {
+	if d.refs.Add(-1) == 0 {
+		_ = os.Remove(d.path)
+		d.done()
+	}
+}
+
+// retainedMessage is a disk-backed message whose consumer disconnected
+// before ACKing it. A consumer with the same principal may resume it.
+type retainedMessage struct {
+	msgID        uint64
+	key          []byte
+	declaredSize uint64
+	partition    uint64
+	headers      []protocol.HeaderField
+	received     time.Time
+	spanCtx      trace.SpanContext
+
+	disk      *diskMessage
+	principal string
+	expires   time.Time // zero: never
+}
+
+// retain keeps m for c's principal if c was still owed it. It is called as
+// the consumer goes away, before m is resolved.
+func (r *Router) retain(c *consumerState, m *routedMessage) {
+	if m.disk == nil || m.aborted.Load() {
+		return
+	}
+	select {
+	case <-m.acked:
+		return
+	default:
+	}
+	if !m.disk.acquire() {
+		return
+	}
+	rm := &retainedMessage{
+		msgID:        m.msgID,
+		key:          m.key,
+		declaredSize: m.declaredSize,
+		partition:    m.partition,
+		headers:      m.headers,
+		received:     m.received,
+		spanCtx:      m.spanCtx,
+		disk:         m.disk,
+		principal:    c.session.Principal,
+	}
+	ttl := r.config().Retention
+	if ttl == 0 && r.uploads != nil {
+		ttl = r.uploads.ttl
+	}
+	if ttl > 0 {
+		rm.expires = time.Now().Add(ttl)
+	}
+	r.rmu.Lock()
+	if old := r.retained[rm.msgID]; old != nil {
+		old.disk.release()
+	}
+	r.retained[rm.msgID] = rm
+	r.rmu.Unlock()
+	c.log.Debug("loom: message retained for resume", logging.KeyMsgID, m.msgID)
+}
+
+// takeRetained removes and returns the message retained under msgID for
+// principal, or nil.
+func (r *Router) takeRetained(msgID uint64, principal string) *retainedMessage {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	rm := r.retained[msgID]
+	if rm == nil || rm.principal != principal {
+		return nil
+	}
+	delete(r.retained, msgID)
+	if !rm.expires.IsZero() && time.Now().After(rm.expires) {
+		rm.disk.release()
+		return nil
+	}
+	return rm
+}
+
+// expireRetained drops retained messages past their expiry.
+func (r *Router) expireRetained(now time.Time) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	for id, rm := range r.retained {
+		if !rm.expires.IsZero() && now.After(rm.expires) {
+			delete(r.retained, id)
+			rm.disk.release()
+		}
+	}
+}
+
+// hasRetained reports whether r holds messages for consumers to resume.
+func (r *Router) hasRetained() bool {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	return len(r.retained) > 0
+}
+
+// resume queues the retained message msgID for c from offset, or tells c
+// it is not retained. It runs on its own goroutine so the consumer's reader
+// keeps reading ACKs while the backlog is full.
+func (r *Router) resume(c *consumerState, msgID, offset uint64) {
+	rm := r.takeRetained(msgID, c.session.Principal)
+	if rm != nil && offset > rm.disk.size {
+		r.rmu.Lock()
+		r.retained[msgID] = rm
+		r.rmu.Unlock()
+		rm = nil
+	}
+	if rm == nil {
+		select {
+		case c.notRetained <- msgID:
+		case <-c.done:
+		}
+		return
+	}
+
+	msg := &routedMessage{
+		key:          rm.key,
+		declaredSize: rm.declaredSize,
+		msgID:        rm.msgID,
+		partition:    rm.partition,
+		headers:      rm.headers,
+		chunks:       make(chan []byte, r.config().MessageChunkQueue),
+		acked:        make(chan struct{}),
+		received:     rm.received,
+		queued:       time.Now(),
+		spanCtx:      rm.spanCtx,
+		disk:         rm.disk, // takes over the retained reference
+		offset:       offset,
+	}
+	select {
+	case c.send <- msg:
+	case <-c.done:
+		// Keep it for the next attempt.
+		r.retain(c, msg)
+		msg.markAcked(false)
+		return
+	}
+	c.log.Debug("loom: resuming message", logging.KeyMsgID, msgID, "offset", offset)
+	r.feedFromDisk(c, msg)
+}
+
+// feedFromDisk streams msg's payload from its offset into its chunk queue.
+func (r *Router) feedFromDisk(c *consumerState, msg *routedMessage) {
+	defer close(msg.chunks)
+	f, err := os.Open(msg.disk.path)
+	if err != nil {
+		c.log.Warn("loom: reading retained message failed", logging.KeyErr, err)
+		msg.aborted.Store(true)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(int64(msg.offset), io.SeekStart); err != nil {
+		msg.aborted.Store(true)
+		return
+	}
+	size := r.config().MaxChunkBytes
+	for {
+		buf := make([]byte, size)
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			select {
+			case msg.chunks <- buf[:n]:
+			case <-c.done:
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			c.log.Warn("loom: reading retained message failed", logging.KeyErr, err)
+			msg.aborted.Store(true)
+			return
+		}
+	}
+}
@@ -1,16 +1,123 @@
 package router
 
 import (
+	"context"
+	"errors"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/BurntRouter/Loom/internal/metrics"
+	"github.com/BurntRouter/Loom/internal/protocol"
+	"github.com/BurntRouter/Loom/internal/subject"
+)
+
+var (
+	ErrUnknownRoom  = errors.New("router: room does not exist and auto-create is disabled")
+	ErrTooManyRooms = errors.New("router: room limit reached")
+	ErrRoomClosed   = errors.New("router: room closed")
 )
 
+// roomReapInterval is how often Run looks for idle rooms.
+const roomReapInterval = 30 * time.Second
+
+// RoomPolicy controls room creation and garbage collection.
+type RoomPolicy struct {
+	// IdleTTL is how long a room without consumers or producers survives.
+	// Zero disables reaping.
+	IdleTTL time.Duration
+	// MaxRooms caps the number of rooms. Zero means unlimited.
+	MaxRooms int
+	// AllowAutoCreate lets clients create rooms by naming them; otherwise
+	// only rooms matching Static may be created.
+	AllowAutoCreate bool
+	// Static rooms are created up front and never reaped.
+	Static []string
+}
+
+func DefaultRoomPolicy() RoomPolicy {
+	return RoomPolicy{AllowAutoCreate: true}
+}
+
+func (p *RoomPolicy) isStatic(room string) bool {
+	for _, s := range p.Static {
+		if s == room {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RoomPolicy) admits(room string) bool {
+	if p.AllowAutoCreate {
+		return true
+	}
+	for _, s := range p.Static {
+		if subject.Match(s, room) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoomOverride replaces parts of the base Config for rooms matching Match,
+// a room name or pattern. Zero fields keep the base value.
+type RoomOverride struct {
+	Match string
+
+	PartitionCount        int
+	MaxMessageBytes       uint64
+	ConsumerQueueDepth    int
+	PartitionFullBehavior string
+	ChunkFullBehavior     string
+	DeliveryMode          string
+	DatagramMaxBytes      int
+	Retention             time.Duration
+}
+
+func (o *RoomOverride) apply(cfg Config) Config {
+	if o.PartitionCount > 0 {
+		cfg.PartitionCount = o.PartitionCount
+	}
+	if o.MaxMessageBytes > 0 {
+		cfg.MaxMessageBytes = o.MaxMessageBytes
+	}
+	if o.ConsumerQueueDepth > 0 {
+		cfg.ConsumerQueueDepth = o.ConsumerQueueDepth
+	}
+	if o.PartitionFullBehavior != "" {
+		cfg.PartitionFullBehavior = o.PartitionFullBehavior
+	}
+	if o.ChunkFullBehavior != "" {
+		cfg.ChunkFullBehavior = o.ChunkFullBehavior
+	}
+	if o.DeliveryMode != "" {
+		cfg.DeliveryMode = o.DeliveryMode
+	}
+	if o.DatagramMaxBytes > 0 {
+		cfg.DatagramMaxBytes = o.DatagramMaxBytes
+	}
+	if o.Retention > 0 {
+		cfg.Retention = o.Retention
+	}
+	return cfg
+}
+
 type RoomManager struct {
-	cfg Config
+	cfg       Config
+	overrides []RoomOverride
 
 	mu           sync.RWMutex
+	policy       RoomPolicy
 	rooms        map[string]*Router
+	wildcards    map[string]*Router // subset of rooms whose name is a pattern
 	errorTracker *ProducerErrorTracker
+
+	drain         chan struct{} // closed by Drain
+	drainOnce     sync.Once
+	drainDeadline time.Time
+
+	uploads *uploadStore // shared by every room
 }
 
 func NewRoomManager(cfg Config) *RoomManager {
@@ -18,12 +125,31 @@ func NewRoomManager(cfg Config) *RoomManager {
 	errorTracker := NewProducerErrorTracker(5*time.Minute, 10)
 	return &RoomManager{
 		cfg:          cfg,
+		policy:       DefaultRoomPolicy(),
 		rooms:        make(map[string]*Router),
+		wildcards:    make(map[string]*Router),
 		errorTracker: errorTracker,
+		drain:        make(chan struct{}),
+		uploads:      newUploadStore(cfg.UploadDir, cfg.UploadTTL),
 	}
 }
 
-func (m *RoomManager) Get(room string) *Router {
+// SetPolicy replaces the room policy and creates any missing static rooms.
+// Existing rooms that the new policy would not admit are left to be reaped
+// once idle.
+func (m *RoomManager) SetPolicy(p RoomPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policy = p
+	for _, name := range p.Static {
+		if m.rooms[name] == nil {
+			m.createLocked(name)
+		}
+	}
+}
+
+// Get returns the router for room, creating it if the policy allows.
+func (m *RoomManager) Get(room string) (*Router, error) {
 	if room == "" {
 		room = "default"
 	}
@@ -31,24 +157,154 @@ func (m *RoomManager) Get(room string) *Router {
 	r := m.rooms[room]
 	m.mu.RUnlock()
 	if r != nil {
-		return r
+		r.touch()
+		return r, nil
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if r = m.rooms[room]; r != nil {
-		return r
+		r.touch()
+		return r, nil
+	}
+	if !m.policy.admits(room) {
+		return nil, ErrUnknownRoom
+	}
+	if m.policy.MaxRooms > 0 && len(m.rooms) >= m.policy.MaxRooms {
+		return nil, ErrTooManyRooms
 	}
-	r = New(m.cfg)
+	return m.createLocked(room), nil
+}
+
+func (m *RoomManager) createLocked(room string) *Router {
+	r := New(m.configForLocked(room))
+	r.room = room
+	r.rooms = m
+	r.uploads = m.uploads
+	r.touch()
 	m.rooms[room] = r
+	if subject.IsPattern(room) {
+		m.wildcards[room] = r
+	}
+	metrics.Rooms.Set(float64(len(m.rooms)))
 	return r
 }
 
-func (m *RoomManager) UpdateConfig(cfg Config) {
+// Run periodically reaps idle rooms, expired staged uploads and retained
+// messages, and expires producer error state until ctx is done.
+func (m *RoomManager) Run(ctx context.Context) {
+	t := time.NewTicker(roomReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.reapIdle(now)
+			m.errorTracker.Cleanup()
+			m.uploads.reap(now)
+			m.expireRetained(now)
+		}
+	}
+}
+
+// reapIdle deletes non-static rooms that have had no consumers or producers
+// for at least the policy's IdleTTL.
+func (m *RoomManager) reapIdle(now time.Time) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.cfg = cfg
+	if m.policy.IdleTTL <= 0 {
+		return
+	}
+	for name, r := range m.rooms {
+		if m.policy.isStatic(name) || r.idleFor(now) < m.policy.IdleTTL {
+			continue
+		}
+		r.retired.Store(true)
+		delete(m.rooms, name)
+		delete(m.wildcards, name)
+	}
+	metrics.Rooms.Set(float64(len(m.rooms)))
+}
+
+// expireRetained drops retained messages past their expiry in every room.
+func (m *RoomManager) expireRetained(now time.Time) {
+	m.mu.RLock()
+	routers := make([]*Router, 0, len(m.rooms))
 	for _, r := range m.rooms {
-		r.SetConfig(cfg)
+		routers = append(routers, r)
+	}
+	m.mu.RUnlock()
+	for _, r := range routers {
+		r.expireRetained(now)
+	}
+}
+
+// BlockedProducers lists producers blocked for repeated protocol errors,
+// sorted by key.
+func (m *RoomManager) BlockedProducers() []BlockedProducer {
+	out := m.errorTracker.Blocked()
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// UnblockProducer lifts a block on the producer with the given
+// "room:name:addr" key.
+func (m *RoomManager) UnblockProducer(key string) bool {
+	return m.errorTracker.Unblock(key)
+}
+
+// subscribers returns r followed by every wildcard room whose pattern
+// matches r's room.
+func (m *RoomManager) subscribers(r *Router) []*Router {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]*Router, 1, 1+len(m.wildcards))
+	out[0] = r
+	for pattern, w := range m.wildcards {
+		if w != r && subject.Match(pattern, r.room) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// validRoom reports whether room may be used with the given role: producers
+// must name a literal room, consumers may subscribe with a pattern.
+func validRoom(role byte, room string) bool {
+	if role == protocol.RoleProducer {
+		return !subject.IsPattern(room)
+	}
+	return subject.ValidPattern(room)
+}
+
+// UpdateConfig replaces the base config and per-room overrides and applies
+// them to every existing room. Connected clients are kept; a new backlog
+// depth only applies to consumers that connect afterwards.
+func (m *RoomManager) UpdateConfig(cfg Config, overrides ...RoomOverride) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	m.overrides = overrides
+	for name, r := range m.rooms {
+		r.SetConfig(m.configForLocked(name))
+	}
+}
+
+// config returns the base config, used before a room is known.
+func (m *RoomManager) config() Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg
+}
+
+// configForLocked returns the base config with the first matching override
+// applied.
+func (m *RoomManager) configForLocked(room string) Config {
+	for i := range m.overrides {
+		if subject.Match(m.overrides[i].Match, room) {
+			return m.overrides[i].apply(m.cfg)
+		}
 	}
+	return m.cfg
 }
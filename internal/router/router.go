@@ -8,12 +8,19 @@ import (
 	"fmt"
 	"hash/maphash"
 	"io"
-	"log"
+	"log/slog"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/BurntRouter/Loom/internal/hash"
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/metrics"
 	"github.com/BurntRouter/Loom/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -31,6 +38,30 @@ type Config struct {
 
 	PartitionFullBehavior string
 	ChunkFullBehavior     string
+	DeliveryMode          string
+
+	// PingInterval and IdleTimeout apply to streams that negotiated
+	// protocol.FeaturePing; zero disables each.
+	PingInterval time.Duration
+	IdleTimeout  time.Duration
+
+	// DatagramMaxBytes is the largest payload sent as a datagram on
+	// sessions that negotiated protocol.FeatureDatagrams; zero disables
+	// datagrams.
+	DatagramMaxBytes int
+
+	// NodeID identifies this server in the server Hello.
+	NodeID string
+
+	// UploadDir is the staging area for resumable uploads; empty disables
+	// them. UploadTTL expires staged uploads untouched for that long. Both
+	// are read when the router or RoomManager is created.
+	UploadDir string
+	UploadTTL time.Duration
+
+	// Retention is how long a message is kept for its consumer to resume;
+	// zero uses UploadTTL.
+	Retention time.Duration
 }
 
 const (
@@ -40,8 +71,36 @@ const (
 
 	ChunkFullDrop  = "drop" // drops the whole message on chunk queue pressure
 	ChunkFullBlock = "block"
+
+	DeliveryAck           = "ack"             // producer waits for the consumer ACK
+	DeliveryFireAndForget = "fire_and_forget" // producer continues once the message is queued
+)
+
+// Drop reasons, the reason label of loom_drops_total.
+const (
+	dropTooLarge         = "too_large"         // over max_message_bytes
+	dropNoConsumer       = "no_consumer"       // no consumer owns the partition
+	dropBadPartition     = "bad_partition"     // explicit partition out of range
+	dropBacklogFull      = "backlog_full"      // consumer backlog full (drop_newest)
+	dropOldestEvicted    = "oldest_evicted"    // evicted from a backlog by drop_oldest
+	dropChunkPressure    = "chunk_pressure"    // chunk queue full (chunk_full_behavior: drop)
+	dropConsumerGone     = "consumer_gone"     // consumer disconnected or was kicked
+	dropPurged           = "purged"            // removed by an admin purge
+	dropAborted          = "aborted"           // aborted by the producer
+	dropDatagramOverflow = "datagram_overflow" // datagrams arriving faster than they are routed
+	dropPaused           = "paused"            // datagram refused by a paused room
 )
 
+func (r *Router) recordDrop(reason string) {
+	r.recordDrops(reason, 1)
+}
+
+// recordDrops counts n messages dropped together, as a batch is.
+func (r *Router) recordDrops(reason string, n int) {
+	metrics.Drops.WithLabelValues(r.room, reason).Add(float64(n))
+	slog.Debug("loom: message dropped", logging.KeyRoom, r.room, "reason", reason, "messages", n)
+}
+
 func defaultMessageChunkQueue(maxChunkBytes int) int {
 	if maxChunkBytes <= 0 {
 		return 1
@@ -66,6 +125,9 @@ func DefaultConfig() Config {
 		ConsumerQueueDepth:    128,
 		PartitionFullBehavior: PartitionFullDropNewest,
 		ChunkFullBehavior:     ChunkFullDrop,
+		DeliveryMode:          DeliveryAck,
+		PingInterval:          15 * time.Second,
+		IdleTimeout:           45 * time.Second,
 	}
 	cfg.MessageChunkQueue = defaultMessageChunkQueue(cfg.MaxChunkBytes)
 	return cfg
@@ -75,20 +137,37 @@ type Router struct {
 	cfg Config
 	rh  *hash.Rendezvous
 
+	// room and rooms are set when the router is owned by a RoomManager.
+	room  string
+	rooms *RoomManager
+
+	lastActive atomic.Int64 // unix nanos of the last Get, join or leave
+	retired    atomic.Bool  // set once the RoomManager has dropped the room
+
 	partSeed maphash.Seed
 
 	mu        sync.RWMutex
 	consumers map[string]*consumerState
+	producers map[string]*producerState
+	paused    *pauseState
 	seq       atomic.Uint64
 	msgSeq    atomic.Uint64
+
+	uploads *uploadStore // nil unless resumable uploads are enabled
+
+	rmu      sync.Mutex
+	retained map[uint64]*retainedMessage // by msg id, for consumers to resume
 }
 
 func New(cfg Config) *Router {
 	return &Router{
 		cfg:       cfg,
+		uploads:   newUploadStore(cfg.UploadDir, cfg.UploadTTL),
 		rh:        hash.NewRendezvous(),
 		partSeed:  maphash.MakeSeed(),
 		consumers: make(map[string]*consumerState),
+		producers: make(map[string]*producerState),
+		retained:  make(map[uint64]*retainedMessage),
 	}
 }
 
@@ -98,48 +177,161 @@ func (r *Router) SetConfig(cfg Config) {
 	r.mu.Unlock()
 }
 
+// config returns a snapshot of the router's current configuration.
+func (r *Router) config() Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cfg
+}
+
+func (r *Router) touch() {
+	r.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the router has had no consumers or producers.
+func (r *Router) idleFor(now time.Time) time.Duration {
+	r.mu.RLock()
+	n := len(r.consumers) + len(r.producers)
+	r.mu.RUnlock()
+	if n > 0 || r.hasRetained() {
+		return 0
+	}
+	return now.Sub(time.Unix(0, r.lastActive.Load()))
+}
+
 type consumerState struct {
-	id     string
-	name   string
-	stream Stream
-	send   chan *routedMessage
-	done   chan struct{}
-	active atomic.Bool
+	id          string
+	name        string
+	version     byte
+	filter      consumerFilter
+	session     Session
+	connectedAt time.Time
+	stream      Stream
+	send        chan *routedMessage
+	done        chan struct{}
+	active      atomic.Bool
+	kicked      chan struct{}
+	kickOnce    sync.Once
+	log         *slog.Logger
+	pings       bool          // negotiated protocol.FeaturePing
+	aborts      bool          // negotiated protocol.FeatureAbort
+	resumes     bool          // negotiated protocol.FeatureResume
+	credits     bool          // negotiated protocol.FeatureCredit
+	datagrams   bool          // negotiated protocol.FeatureDatagrams
+	batches     bool          // negotiated protocol.FeatureBatch
+	lastHeard   atomic.Int64  // unix nanos of the last frame read or message written
+	notRetained chan uint64   // resume requests that could not be served
+	wake        chan struct{} // the delivery window may have room
+	slots       chan struct{} // one per open data stream; nil without protocol.FeatureStreams
+
+	// Delivery window; see setCredit.
+	creditMessages atomic.Uint64
+	creditBytes    atomic.Uint64
+
+	messagesSent atomic.Uint64
+	bytesSent    atomic.Uint64
 
 	pmu     sync.Mutex
 	pending map[uint64]*routedMessage
 }
 
+type producerState struct {
+	id          string
+	session     Session
+	connectedAt time.Time
+	aborts      bool // negotiated protocol.FeatureAbort
+	resumes     bool // negotiated protocol.FeatureResume
+	batches     bool // negotiated protocol.FeatureBatch
+
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+}
+
 type routedMessage struct {
 	key          []byte
 	declaredSize uint64
 	msgID        uint64
+	partition    uint64
+	headers      []protocol.HeaderField
 	chunks       chan []byte
 	canceled     atomic.Bool
+	aborted      atomic.Bool           // chunks ended before the end of the message
+	disk         *diskMessage          // payload on disk, for messages staged as uploads
+	offset       uint64                // first byte delivered, when resumed
+	lossy        bool                  // arrived as a datagram
+	batch        []protocol.BatchEntry // set for a batch, delivered in one BATCH frame
+	sent         uint64                // payload bytes counted against the consumer's window
+	await        trace.Span            // loom.await_ack, while pending
+
+	received time.Time // when the producer's header was read
+	queued   time.Time // when it entered the consumer backlog
+	spanCtx  trace.SpanContext
 
 	ackedOK atomic.Bool
 	acked   chan struct{}
 	once    sync.Once
+
+	// window is the consumer whose delivery window counts the message while
+	// it is pending; resolving the message wakes that consumer's writer.
+	window atomic.Pointer[consumerState]
 }
 
-func (m *routedMessage) markAcked(ok bool) {
-	if ok {
-		m.ackedOK.Store(true)
-	}
-	m.once.Do(func() { close(m.acked) })
+// markAcked resolves the message. It reports whether this call resolved it.
+func (m *routedMessage) markAcked(ok bool) bool {
+	first := false
+	m.once.Do(func() {
+		if ok {
+			m.ackedOK.Store(true)
+		}
+		close(m.acked)
+		if m.disk != nil {
+			m.disk.release()
+		}
+		if c := m.window.Load(); c != nil {
+			c.signal()
+		}
+		first = true
+	})
+	return first
 }
 
-func (r *Router) RegisterConsumer(name string, stream Stream) (string, error) {
+// RegisterConsumer attaches a consumer stream to the router and starts
+// delivering messages to it. It returns the consumer id.
+func (r *Router) RegisterConsumer(sess Session, stream Stream) (string, error) {
+	if r.retired.Load() {
+		return "", ErrRoomClosed
+	}
+	cfg := r.config()
 	id := fmt.Sprintf("c-%d", r.seq.Add(1))
 	c := &consumerState{
-		id:      id,
-		name:    name,
-		stream:  stream,
-		send:    make(chan *routedMessage, r.cfg.ConsumerQueueDepth),
-		done:    make(chan struct{}),
-		pending: make(map[uint64]*routedMessage),
+		id:          id,
+		name:        sess.Hello.Name,
+		version:     sess.Hello.Version,
+		filter:      newConsumerFilter(sess.Hello.Filter),
+		session:     sess,
+		connectedAt: time.Now(),
+		stream:      stream,
+		send:        make(chan *routedMessage, cfg.ConsumerQueueDepth),
+		done:        make(chan struct{}),
+		kicked:      make(chan struct{}),
+		log:         sess.logger().With(logging.KeyConsumerID, id),
+		pending:     make(map[uint64]*routedMessage),
+		pings:       r.features(sess)&protocol.FeaturePing != 0,
+		aborts:      r.features(sess)&protocol.FeatureAbort != 0,
+		resumes:     r.features(sess)&protocol.FeatureResume != 0,
+		notRetained: make(chan uint64),
+		credits:     r.features(sess)&protocol.FeatureCredit != 0,
+		datagrams:   r.features(sess)&protocol.FeatureDatagrams != 0,
+		batches:     r.features(sess)&protocol.FeatureBatch != 0,
+		wake:        make(chan struct{}, 1),
+	}
+	c.creditMessages.Store(defaultCreditMessages)
+	if n := r.dataStreams(sess); n > 0 {
+		c.slots = make(chan struct{}, n)
+		c.creditMessages.Store(uint64(n))
 	}
 	c.active.Store(true)
+	c.heard()
 
 	r.mu.Lock()
 	r.consumers[id] = c
@@ -154,13 +346,20 @@ func (r *Router) removeConsumer(id string) {
 	r.mu.Lock()
 	delete(r.consumers, id)
 	r.mu.Unlock()
+	r.touch()
 }
 
 func (r *Router) runConsumerWriter(c *consumerState) {
 	defer func() {
 		c.pmu.Lock()
 		for _, m := range c.pending {
+			if c.resumes {
+				r.retain(c, m)
+			}
 			m.markAcked(false)
+			if m.await != nil {
+				endSpan(m.await, errConsumerClosed)
+			}
 		}
 		c.pmu.Unlock()
 
@@ -168,57 +367,196 @@ func (r *Router) runConsumerWriter(c *consumerState) {
 		close(c.done)
 		r.removeConsumer(c.id)
 		_ = c.stream.Close()
+		c.log.Info("loom: consumer disconnected", "messages", c.messagesSent.Load(), "bytes", c.bytesSent.Load())
 	}()
 
+	if err := r.writeServerHello(c.stream, c.session, c.id); err != nil {
+		c.log.Warn("loom: server hello failed", logging.KeyErr, err)
+		return
+	}
+
 	w := bufio.NewWriter(c.stream)
+	chunkWrite := metrics.ChunkWriteLatency.WithLabelValues(r.room)
+	ping := r.pingTicker(c.pings)
+	defer ping.Stop()
 	for {
+		// Take another message only while the delivery window has room.
+		var send <-chan *routedMessage
+		if c.settle() && (c.slots == nil || c.slotFree()) {
+			send = c.send
+		}
 		select {
 		case <-c.stream.Context().Done():
 			return
-		case msg, ok := <-c.send:
-			if !ok {
+		case <-c.kicked:
+			return
+		case <-c.wake:
+		case <-ping.C():
+			if err := r.pingConsumer(w, c); err != nil {
+				c.log.Warn("loom: closing consumer", logging.KeyErr, err)
 				return
 			}
-			if !c.active.Load() {
-				msg.canceled.Store(true)
-				msg.markAcked(false)
-				continue
+		case id := <-c.notRetained:
+			if err := protocol.WriteControlFrame(w, protocol.FrameNotRetained, id); err != nil {
+				return
 			}
-
-			c.pmu.Lock()
-			c.pending[msg.msgID] = msg
-			c.pmu.Unlock()
-
-			if err := protocol.WriteMessageHeader(w, msg.key, msg.declaredSize, msg.msgID); err != nil {
-				log.Printf("consumer %s write header: %v", c.id, err)
+		case msg, ok := <-send:
+			if !ok {
 				return
 			}
-			for chunk := range msg.chunks {
-				if err := protocol.WriteChunk(w, chunk); err != nil {
-					log.Printf("consumer %s write chunk: %v", c.id, err)
-					return
+			if msg.lossy && c.datagrams {
+				if msg = r.sendDatagram(c, msg); msg == nil {
+					continue
 				}
 			}
-			if err := protocol.WriteEndOfMessage(w); err != nil {
-				log.Printf("consumer %s write eom: %v", c.id, err)
-				return
-			}
-			if err := w.Flush(); err != nil {
-				log.Printf("consumer %s flush: %v", c.id, err)
+			if c.slots != nil {
+				c.dispatch(msg)
+				c.slots <- struct{}{}
+				go r.deliverOnStream(c, msg, chunkWrite)
+			} else if !r.deliver(w, c, msg, chunkWrite) {
 				return
 			}
+		}
+	}
+}
 
-			select {
-			case <-msg.acked:
-			case <-c.stream.Context().Done():
-				return
-			}
+// deliver writes msg to c and leaves it pending until ACKed. It reports
+// false if the writer must stop.
+func (r *Router) deliver(w *bufio.Writer, c *consumerState, msg *routedMessage, chunkWrite prometheus.Observer) bool {
+	if ok, err := r.admit(c, msg); !ok {
+		return err == nil
+	}
+	if err := r.transmit(w, c, msg, chunkWrite); err != nil {
+		c.log.Warn("loom: consumer write failed", logging.KeyErr, err)
+		return false
+	}
+	return true
+}
 
-			c.pmu.Lock()
-			delete(c.pending, msg.msgID)
-			c.pmu.Unlock()
+// admit waits until msg may be written to c. If it may not, msg is resolved
+// and admit reports false, with an error if c is done.
+func (r *Router) admit(c *consumerState, msg *routedMessage) (bool, error) {
+	err := r.waitRunning(c.stream.Context(), c.kicked, false)
+	if err != nil || !c.active.Load() {
+		msg.canceled.Store(true)
+		if msg.markAcked(false) {
+			r.recordDrops(dropConsumerGone, msg.count())
 		}
+		return false, err
 	}
+	if msg.aborted.Load() {
+		// Aborted while queued: nothing has been written, so skip it.
+		msg.markAcked(false)
+		return false, nil
+	}
+	return true, nil
+}
+
+// transmit writes msg to c on w and leaves it pending until ACKed.
+func (r *Router) transmit(w *bufio.Writer, c *consumerState, msg *routedMessage, chunkWrite prometheus.Observer) error {
+	metrics.QueueWait.WithLabelValues(r.room).Observe(time.Since(msg.queued).Seconds())
+	startConsumerSpan(msg, c, "loom.queue_wait", trace.WithTimestamp(msg.queued)).End()
+
+	c.pmu.Lock()
+	c.addPending(msg)
+	c.pmu.Unlock()
+
+	write := startConsumerSpan(msg, c, "loom.write")
+	sent, err := r.writeMessage(w, c, msg, chunkWrite)
+	endSpan(write, err)
+	if err != nil {
+		return err
+	}
+	c.heard()
+	if c.aborts && msg.aborted.Load() {
+		// The consumer discards an aborted message without an ACK.
+		msg.markAcked(false)
+		c.pmu.Lock()
+		delete(c.pending, msg.msgID)
+		c.pmu.Unlock()
+		return nil
+	}
+	c.messagesSent.Add(uint64(msg.count()))
+	metrics.MessagesOut.WithLabelValues(r.room).Add(float64(msg.count()))
+	c.log.Debug("loom: message written", logging.KeyMsgID, msg.msgID, "partition", msg.partition)
+
+	c.pmu.Lock()
+	await := startConsumerSpan(msg, c, "loom.await_ack")
+	if c.pending[msg.msgID] == msg {
+		msg.sent = sent
+		msg.await = await
+	} else {
+		// ACKed before the write returned.
+		await.End()
+	}
+	c.pmu.Unlock()
+	return nil
+}
+
+// count is the number of messages m carries.
+func (m *routedMessage) count() int {
+	if m.batch != nil {
+		return len(m.batch)
+	}
+	return 1
+}
+
+// header is the header msg is delivered with.
+func (m *routedMessage) header() protocol.MessageHeader {
+	return protocol.MessageHeader{
+		Key:          m.key,
+		DeclaredSize: m.declaredSize,
+		MsgID:        m.msgID,
+		Partition:    m.partition,
+		HasPartition: true,
+		Headers:      m.headers,
+		Offset:       m.offset,
+		HasOffset:    m.offset > 0,
+	}
+}
+
+// writeMessage writes msg to the consumer and flushes it. It returns the
+// payload bytes written.
+func (r *Router) writeMessage(w *bufio.Writer, c *consumerState, msg *routedMessage, chunkWrite prometheus.Observer) (uint64, error) {
+	if msg.batch != nil {
+		return r.writeBatch(w, c, msg)
+	}
+	if err := protocol.WriteMessageHeader(w, c.version, msg.header()); err != nil {
+		return 0, fmt.Errorf("write header: %w", err)
+	}
+	var sent uint64
+	for chunk := range msg.chunks {
+		// Flushing each chunk times the stream write rather than the copy
+		// into w, so stream flow control shows in the histogram.
+		start := time.Now()
+		if err := protocol.WriteChunk(w, chunk); err != nil {
+			return sent, fmt.Errorf("write chunk: %w", err)
+		}
+		if err := w.Flush(); err != nil {
+			return sent, fmt.Errorf("flush: %w", err)
+		}
+		chunkWrite.Observe(time.Since(start).Seconds())
+		sent += uint64(len(chunk))
+		c.bytesSent.Add(uint64(len(chunk)))
+		metrics.BytesOut.WithLabelValues(r.room).Add(float64(len(chunk)))
+	}
+	var err error
+	if c.aborts {
+		code := protocol.EndComplete
+		if msg.aborted.Load() {
+			code = protocol.EndAborted
+		}
+		err = protocol.WriteMessageEnd(w, code)
+	} else {
+		err = protocol.WriteEndOfMessage(w)
+	}
+	if err != nil {
+		return sent, fmt.Errorf("write eom: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return sent, fmt.Errorf("flush: %w", err)
+	}
+	return sent, nil
 }
 
 func (r *Router) runConsumerReader(c *consumerState) {
@@ -228,19 +566,68 @@ func (r *Router) runConsumerReader(c *consumerState) {
 		if err != nil {
 			return
 		}
-		if ft != protocol.FrameAck {
-			continue
-		}
-		c.pmu.Lock()
-		m := c.pending[msgID]
-		c.pmu.Unlock()
-		if m != nil {
-			m.markAcked(true)
+		c.heard()
+		switch ft {
+		case protocol.FrameAck:
+			r.ack(c, msgID)
+		case protocol.FrameResume:
+			offset, err := protocol.ReadResumeOffset(br)
+			if err != nil {
+				return
+			}
+			if c.resumes {
+				go r.resume(c, msgID, offset)
+			}
+		case protocol.FrameCredit:
+			bytes, err := protocol.ReadCreditBytes(br)
+			if err != nil {
+				return
+			}
+			if c.credits {
+				r.setCredit(c, msgID, bytes)
+			}
 		}
 	}
 }
 
-func (r *Router) HandleProducer(ctx context.Context, br *bufio.Reader) error {
+// HandleProducer reads messages from a producer stream and routes them until
+// EOF or ctx is done. Each message is delivered to one consumer of r and of
+// every wildcard subscription matching r's room. A room the RoomManager has
+// dropped returns ErrRoomClosed, so the producer reconnects to its successor.
+func (r *Router) HandleProducer(ctx context.Context, sess Session, br *bufio.Reader) error {
+	if r.retired.Load() {
+		return ErrRoomClosed
+	}
+	version := sess.Hello.Version
+	features := r.features(sess)
+	var idle time.Duration
+	if features&protocol.FeaturePing != 0 {
+		idle = r.config().IdleTimeout
+	}
+	p := &producerState{
+		id:          fmt.Sprintf("p-%d", r.seq.Add(1)),
+		session:     sess,
+		connectedAt: time.Now(),
+		aborts:      features&protocol.FeatureAbort != 0,
+		resumes:     features&protocol.FeatureResume != 0,
+		batches:     features&protocol.FeatureBatch != 0,
+	}
+	r.mu.Lock()
+	r.producers[p.id] = p
+	r.mu.Unlock()
+	if features&protocol.FeatureDatagrams != 0 {
+		stop := r.receiveDatagrams(ctx, p)
+		defer stop()
+	}
+	defer func() {
+		r.mu.Lock()
+		delete(r.producers, p.id)
+		r.mu.Unlock()
+		r.touch()
+	}()
+	boundary := newBoundaryWatcher(br)
+	defer boundary.stop()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -248,180 +635,431 @@ func (r *Router) HandleProducer(ctx context.Context, br *bufio.Reader) error {
 		default:
 		}
 
-		hdr, err := protocol.ReadMessageHeader(br, r.cfg.MaxKeyBytes)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
+		// A paused room holds or rejects producers between messages, and a
+		// draining server stops reading at the next message boundary.
+		if err := r.waitRunning(ctx, r.draining(), true); err != nil {
+			if r.rooms != nil && r.rooms.Draining() {
 				return nil
 			}
 			return err
 		}
-
-		if hdr.DeclaredSize > 0 && uint64(hdr.DeclaredSize) > r.cfg.MaxMessageBytes {
-			if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
+		if ok, err := r.nextMessage(ctx, boundary, idle); !ok {
+			return err
+		}
+		if version >= protocol.Version6 {
+			// Control frames (PONGs, upload queries, batches) may arrive
+			// between messages.
+			ctl, err := protocol.IsControlFrame(br)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
 				return err
 			}
-			continue
+			if ctl {
+				ft, v, err := protocol.ReadControlFrame(br)
+				if err != nil {
+					return err
+				}
+				switch ft {
+				case protocol.FrameUploadQuery:
+					err = r.queryUpload(ctx, p, v)
+				case protocol.FrameBatch:
+					err = r.routeBatch(ctx, br, r.config(), p, v)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
 		}
 
-		c := r.pickConsumer(hdr.Key)
-		if c == nil {
-			if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-				return err
+		cfg := r.config()
+		hdr, err := protocol.ReadMessageHeader(br, version, cfg.MaxKeyBytes)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
 			}
-			continue
+			return err
 		}
-		consumerDone := c.done
-		select {
-		case <-consumerDone:
-			if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-				return err
-			}
-			continue
-		default:
+		if hdr.HasUpload {
+			err = r.stageUpload(ctx, br, cfg, p, hdr)
+		} else {
+			err = r.routeMessage(ctx, br, cfg, p, hdr, origin{})
 		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// origin describes how a message reached the router, for those that did not
+// simply arrive on a producer stream.
+type origin struct {
+	disk  *diskMessage // staged as an upload: deliveries can be resumed
+	lossy bool         // sent as a datagram: delivered best effort, never awaited
+}
+
+// routeMessage delivers one message whose header has been read, discarding
+// its body if nothing can take it.
+func (r *Router) routeMessage(ctx context.Context, br *bufio.Reader, cfg Config, p *producerState, hdr protocol.MessageHeader, o origin) error {
+	received := time.Now()
+	metrics.MessagesIn.WithLabelValues(r.room).Inc()
 
-		msg := &routedMessage{
-			key:          hdr.Key,
-			declaredSize: hdr.DeclaredSize,
-			msgID:        r.msgSeq.Add(1),
-			chunks:       make(chan []byte, r.cfg.MessageChunkQueue),
-			acked:        make(chan struct{}),
+	ctx, span := r.startReceiveSpan(ctx, &hdr)
+	defer span.End()
+
+	if hdr.DeclaredSize > 0 && uint64(hdr.DeclaredSize) > cfg.MaxMessageBytes {
+		r.recordDrop(dropTooLarge)
+		span.SetStatus(codes.Error, dropTooLarge)
+		return discardMessage(br, cfg, p)
+	}
+
+	// An explicit partition bypasses key hashing; out-of-range partitions
+	// are discarded like oversized messages.
+	if hdr.HasPartition && hdr.Partition >= uint64(cfg.PartitionCount) {
+		r.recordDrop(dropBadPartition)
+		span.SetStatus(codes.Error, dropBadPartition)
+		return discardMessage(br, cfg, p)
+	}
+
+	_, route := tracer().Start(ctx, "loom.route")
+	var deliveries []*delivery
+	routed := false
+	for _, t := range r.targets() {
+		d, ok, err := t.enqueue(ctx, &hdr, received, o)
+		routed = routed || ok
+		if err != nil {
+			route.End()
+			closeDeliveries(deliveries)
+			return err
 		}
+		if d != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	route.SetAttributes(attribute.Int("loom.deliveries", len(deliveries)))
+	route.End()
+	if len(deliveries) == 0 {
+		// Copies queue dropped have already been counted.
+		if !routed {
+			r.recordDrop(dropNoConsumer)
+			span.SetStatus(codes.Error, dropNoConsumer)
+		}
+		return discardMessage(br, cfg, p)
+	}
 
-		switch r.cfg.PartitionFullBehavior {
-		case PartitionFullBlock:
-			select {
-			case c.send <- msg:
-			case <-consumerDone:
-				if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-					return err
-				}
-				continue
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		case PartitionFullDropOldest:
+	n, err := r.forwardChunks(ctx, br, cfg, p, deliveries)
+	p.messages.Add(1)
+	p.bytes.Add(n)
+	metrics.BytesIn.WithLabelValues(r.room).Add(float64(n))
+	span.SetAttributes(attribute.Int64("loom.bytes", int64(n)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	metrics.MessageSize.WithLabelValues(r.room).Observe(float64(n))
+	return nil
+}
+
+// delivery is one copy of an incoming message queued for a single consumer.
+type delivery struct {
+	r       *Router // target router
+	cfg     Config  // snapshot of the target router's config
+	c       *consumerState
+	msg     *routedMessage
+	closed  bool
+	dropped bool
+}
+
+// finish closes the chunk queue, ending the message for the consumer.
+func (d *delivery) finish() {
+	if !d.closed {
+		d.closed = true
+		close(d.msg.chunks)
+	}
+}
+
+// drop stops forwarding chunks to the delivery. The consumer is told the
+// message was aborted if it negotiated aborts.
+func (d *delivery) drop() {
+	d.dropped = true
+	if !d.closed {
+		d.msg.aborted.Store(true)
+	}
+	d.finish()
+}
+
+// discardMessage skips the rest of the producer's current message.
+func discardMessage(br *bufio.Reader, cfg Config, p *producerState) error {
+	if err := protocol.DiscardMessage(br, cfg.MaxChunkBytes); err != nil {
+		return err
+	}
+	if p.aborts {
+		_, err := protocol.ReadEndCode(br)
+		return err
+	}
+	return nil
+}
+
+func closeDeliveries(ds []*delivery) {
+	for _, d := range ds {
+		d.msg.canceled.Store(true)
+		d.drop()
+	}
+}
+
+// targets returns the routers a message produced into r is delivered to.
+func (r *Router) targets() []*Router {
+	if r.rooms == nil {
+		return []*Router{r}
+	}
+	return r.rooms.subscribers(r)
+}
+
+// enqueue picks a consumer of r for the message and queues a copy for it
+// according to the partition-full behavior. It returns nil if the message
+// is not delivered by r, and reports whether r had a consumer for it at all.
+func (r *Router) enqueue(ctx context.Context, hdr *protocol.MessageHeader, received time.Time, o origin) (*delivery, bool, error) {
+	cfg := r.config()
+	part, c := r.route(hdr, cfg)
+	if c == nil {
+		return nil, false, nil
+	}
+	msg := &routedMessage{
+		key:          hdr.Key,
+		declaredSize: hdr.DeclaredSize,
+		msgID:        r.msgSeq.Add(1),
+		partition:    part,
+		headers:      hdr.Headers,
+		chunks:       make(chan []byte, cfg.MessageChunkQueue),
+		acked:        make(chan struct{}),
+		received:     received,
+		queued:       time.Now(),
+		spanCtx:      trace.SpanContextFromContext(ctx),
+		lossy:        o.lossy,
+	}
+	if o.disk != nil && o.disk.acquire() {
+		msg.disk = o.disk
+	}
+	d, err := r.queue(ctx, cfg, c, msg)
+	return d, true, err
+}
+
+// route picks the partition of the message and the consumer of r owning
+// it, or a nil consumer if none does.
+func (r *Router) route(hdr *protocol.MessageHeader, cfg Config) (uint64, *consumerState) {
+	var part uint64
+	if hdr.HasPartition {
+		if hdr.Partition >= uint64(cfg.PartitionCount) {
+			return 0, nil
+		}
+		part = hdr.Partition
+	} else {
+		part = r.partitionFor(hdr.Key, cfg.PartitionCount)
+	}
+	return part, r.pickConsumer(part, hdr)
+}
+
+// queue adds msg to c's backlog according to the partition-full behavior.
+// It returns nil if msg was dropped instead.
+func (r *Router) queue(ctx context.Context, cfg Config, c *consumerState, msg *routedMessage) (*delivery, error) {
+	consumerDone := c.done
+	select {
+	case <-consumerDone:
+		msg.markAcked(false)
+		r.recordDrops(dropConsumerGone, msg.count())
+		return nil, nil
+	default:
+	}
+
+	behavior := cfg.PartitionFullBehavior
+	if msg.lossy && behavior == PartitionFullBlock {
+		// Datagrams are never held up by a full backlog.
+		behavior = PartitionFullDropNewest
+	}
+	switch behavior {
+	case PartitionFullBlock:
+		select {
+		case c.send <- msg:
+		case <-consumerDone:
+			msg.markAcked(false)
+			r.recordDrops(dropConsumerGone, msg.count())
+			return nil, nil
+		case <-ctx.Done():
+			msg.markAcked(false)
+			return nil, ctx.Err()
+		}
+	case PartitionFullDropOldest:
+		select {
+		case c.send <- msg:
+			// queued
+		default:
 			select {
-			case c.send <- msg:
-				// queued
+			case dropped := <-c.send:
+				dropped.canceled.Store(true)
+				dropped.markAcked(false)
+				r.recordDrops(dropOldestEvicted, dropped.count())
 			default:
-				select {
-				case dropped := <-c.send:
-					dropped.canceled.Store(true)
-				default:
-				}
-				select {
-				case c.send <- msg:
-				default:
-					if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-						return err
-					}
-					continue
-				}
 			}
-		default: // drop newest
 			select {
 			case c.send <- msg:
 			default:
-				if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-					return err
-				}
-				continue
+				msg.markAcked(false)
+				r.recordDrops(dropBacklogFull, msg.count())
+				return nil, nil
 			}
 		}
+	default: // drop newest
+		select {
+		case c.send <- msg:
+		default:
+			msg.markAcked(false)
+			r.recordDrops(dropBacklogFull, msg.count())
+			return nil, nil
+		}
+	}
+	return &delivery{r: r, cfg: cfg, c: c, msg: msg}, nil
+}
 
-		dropped := false
-		var total uint64
-	readChunks:
-		for {
-			chunk, done, err := protocol.ReadChunk(br, r.cfg.MaxChunkBytes)
+// forwardChunks copies the message body to every delivery, dropping
+// individual deliveries under pressure, and waits for the remaining ones to
+// be ACKed. Limits come from the producer's room config. It returns the
+// number of payload bytes read.
+func (r *Router) forwardChunks(ctx context.Context, br *bufio.Reader, cfg Config, p *producerState, deliveries []*delivery) (uint64, error) {
+	var total uint64
+	for {
+		chunk, done, err := protocol.ReadChunk(br, cfg.MaxChunkBytes)
+		if err != nil {
+			closeDeliveries(deliveries)
+			return total, err
+		}
+		if done && p.aborts {
+			code, err := protocol.ReadEndCode(br)
 			if err != nil {
-				close(msg.chunks)
-				return err
+				closeDeliveries(deliveries)
+				return total, err
 			}
-			if done {
-				close(msg.chunks)
-				select {
-				case <-msg.acked:
-				case <-consumerDone:
-					msg.markAcked(false)
-				case <-ctx.Done():
-					msg.markAcked(false)
-					return ctx.Err()
-				}
-				break
+			if code == protocol.EndAborted {
+				r.recordDrop(dropAborted)
+				closeDeliveries(deliveries)
+				return total, nil
 			}
-
-			total += uint64(len(chunk))
-			if total > r.cfg.MaxMessageBytes {
-				dropped = true
-				close(msg.chunks)
-				if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-					return err
-				}
-				break readChunks
+		}
+		if done {
+			for _, d := range deliveries {
+				d.finish()
 			}
+			return total, waitAcked(ctx, deliveries)
+		}
 
-			if msg.canceled.Load() {
-				dropped = true
+		total += uint64(len(chunk))
+		if total > cfg.MaxMessageBytes {
+			r.recordDrop(dropTooLarge)
+			closeDeliveries(deliveries)
+			return total, discardMessage(br, cfg, p)
+		}
+
+		live := 0
+		for _, d := range deliveries {
+			if d.dropped {
+				continue
+			}
+			if d.msg.canceled.Load() {
+				d.drop()
+				continue
+			}
+			ok, err := d.push(ctx, chunk)
+			if err != nil {
+				closeDeliveries(deliveries)
+				return total, err
 			}
-			if dropped {
+			if !ok {
+				d.drop()
 				continue
 			}
+			live++
+		}
+		if live == 0 {
+			return total, discardMessage(br, cfg, p)
+		}
+	}
+}
 
-			switch r.cfg.ChunkFullBehavior {
-			case ChunkFullBlock:
-				select {
-				case msg.chunks <- chunk:
-				case <-consumerDone:
-					dropped = true
-					close(msg.chunks)
-					if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-						return err
-					}
-					break readChunks
-				case <-ctx.Done():
-					close(msg.chunks)
-					return ctx.Err()
-				}
-			default:
-				select {
-				case <-consumerDone:
-					dropped = true
-					close(msg.chunks)
-					if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-						return err
-					}
-					break readChunks
-				default:
-				}
-				select {
-				case msg.chunks <- chunk:
-				default:
-					dropped = true
-					close(msg.chunks)
-					if err := protocol.DiscardMessage(br, r.cfg.MaxChunkBytes); err != nil {
-						return err
-					}
-					break readChunks
-				}
+// push hands a chunk to the delivery's consumer according to the chunk-full
+// behavior. It reports false if the delivery must be dropped.
+func (d *delivery) push(ctx context.Context, chunk []byte) (bool, error) {
+	consumerDone := d.c.done
+	behavior := d.cfg.ChunkFullBehavior
+	if d.msg.lossy {
+		// Datagrams are never held up by a full chunk queue either.
+		behavior = ChunkFullDrop
+	}
+	switch behavior {
+	case ChunkFullBlock:
+		select {
+		case d.msg.chunks <- chunk:
+			return true, nil
+		case <-consumerDone:
+			d.r.recordDrop(dropConsumerGone)
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	default:
+		select {
+		case <-consumerDone:
+			d.r.recordDrop(dropConsumerGone)
+			return false, nil
+		default:
+		}
+		select {
+		case d.msg.chunks <- chunk:
+			return true, nil
+		default:
+			d.r.recordDrop(dropChunkPressure)
+			return false, nil
+		}
+	}
+}
+
+// waitAcked blocks until every delivery that was fully forwarded has been
+// ACKed or its consumer has gone away. Fire-and-forget rooms and
+// datagrams do not wait.
+func waitAcked(ctx context.Context, deliveries []*delivery) error {
+	for _, d := range deliveries {
+		if d.dropped || d.msg.canceled.Load() || d.msg.lossy || d.cfg.DeliveryMode == DeliveryFireAndForget {
+			continue
+		}
+		select {
+		case <-d.msg.acked:
+		case <-d.c.done:
+			d.r.recordDrops(dropConsumerGone, d.msg.count())
+			d.msg.markAcked(false)
+		case <-ctx.Done():
+			for _, d := range deliveries {
+				d.msg.markAcked(false)
 			}
+			return ctx.Err()
 		}
 	}
+	return nil
 }
 
-func (r *Router) pickConsumer(key []byte) *consumerState {
+// pickConsumer chooses among the active consumers whose filter matches the
+// message, using rendezvous hashing on the partition.
+func (r *Router) pickConsumer(part uint64, hdr *protocol.MessageHeader) *consumerState {
 	r.mu.RLock()
 	ids := make([]string, 0, len(r.consumers))
 	for id, c := range r.consumers {
-		if c.active.Load() {
+		if c.active.Load() && c.filter.matches(part, hdr) {
 			ids = append(ids, id)
 		}
 	}
 	r.mu.RUnlock()
 
-	partKey := r.partitionKey(key)
-	id, ok := r.rh.Pick(partKey, ids)
+	id, ok := r.rh.Pick(partitionKey(part), ids)
 	if !ok {
 		return nil
 	}
@@ -434,12 +1072,16 @@ func (r *Router) pickConsumer(key []byte) *consumerState {
 	return c
 }
 
-func (r *Router) partitionKey(key []byte) []byte {
+// partitionFor maps a routing key to its partition.
+func (r *Router) partitionFor(key []byte, partitionCount int) uint64 {
 	var h maphash.Hash
 	h.SetSeed(r.partSeed)
 	_, _ = h.Write(key)
-	part := h.Sum64() % uint64(r.cfg.PartitionCount)
+	return h.Sum64() % uint64(partitionCount)
+}
 
+// partitionKey encodes a partition number as the rendezvous hashing key.
+func partitionKey(part uint64) []byte {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, part)
 	return buf
@@ -4,12 +4,30 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/BurntRouter/Loom/internal/auth"
+	"github.com/BurntRouter/Loom/internal/metrics"
 	"github.com/BurntRouter/Loom/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type ctxConn struct {
@@ -29,7 +47,7 @@ func TestProducerWaitsForConsumerAck(t *testing.T) {
 	consumerStream := &ctxConn{Conn: c1, ctx: ctx}
 	clientSide := &ctxConn{Conn: c2, ctx: ctx}
 
-	_, err := r.RegisterConsumer("c", consumerStream)
+	_, err := r.RegisterConsumer(Session{Hello: protocol.Hello{Version: protocol.Version4, Role: protocol.RoleConsumer, Name: "c"}}, consumerStream)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,7 +55,7 @@ func TestProducerWaitsForConsumerAck(t *testing.T) {
 	// Build one message from a producer.
 	var prod bytes.Buffer
 	pw := bufio.NewWriter(&prod)
-	if err := protocol.WriteMessageHeader(pw, []byte("key"), 0, 0); err != nil {
+	if err := protocol.WriteMessageHeader(pw, protocol.Version4, protocol.MessageHeader{Key: []byte("key")}); err != nil {
 		t.Fatal(err)
 	}
 	if err := protocol.WriteChunk(pw, []byte("hello")); err != nil {
@@ -59,12 +77,12 @@ func TestProducerWaitsForConsumerAck(t *testing.T) {
 	prodDone := make(chan error, 1)
 	go func() {
 		defer wg.Done()
-		prodDone <- r.HandleProducer(pctx, bufio.NewReader(bytes.NewReader(prod.Bytes())))
+		prodDone <- r.HandleProducer(pctx, producerSession(protocol.Version4), bufio.NewReader(bytes.NewReader(prod.Bytes())))
 	}()
 
 	// Read the routed message from consumer side.
 	cr := bufio.NewReader(clientSide)
-	hdr, err := protocol.ReadMessageHeader(cr, 256)
+	hdr, err := protocol.ReadMessageHeader(cr, protocol.Version4, 256)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,3 +133,1864 @@ func TestProducerWaitsForConsumerAck(t *testing.T) {
 	wg.Wait()
 	_ = clientSide.Close()
 }
+
+// pipeConsumer registers a consumer on r backed by an in-memory pipe and
+// returns the client side of the pipe.
+func pipeConsumer(t *testing.T, ctx context.Context, r *Router, hello protocol.Hello) net.Conn {
+	t.Helper()
+	return pipeSession(t, ctx, r, Session{Hello: hello})
+}
+
+// pipeSession is pipeConsumer for a consumer session with more than a Hello.
+func pipeSession(t *testing.T, ctx context.Context, r *Router, sess Session) net.Conn {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	sess.Hello.Role = protocol.RoleConsumer
+	if _, err := r.RegisterConsumer(sess, &ctxConn{Conn: c1, ctx: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c2.Close() })
+	return c2
+}
+
+func producerSession(version byte) Session {
+	return Session{Hello: protocol.Hello{Version: version, Role: protocol.RoleProducer, Name: "p"}}
+}
+
+// encodeMessages frames one single-chunk message per header.
+func encodeMessages(t *testing.T, version byte, hdrs ...protocol.MessageHeader) *bufio.Reader {
+	t.Helper()
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	for _, h := range hdrs {
+		if err := protocol.WriteMessageHeader(w, version, h); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.WriteChunk(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.WriteEndOfMessage(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return bufio.NewReader(bytes.NewReader(b.Bytes()))
+}
+
+// receiveAndAck reads one message from a consumer pipe and ACKs it.
+func receiveAndAck(t *testing.T, conn net.Conn, br *bufio.Reader, version byte) protocol.MessageHeader {
+	t.Helper()
+	hdr, err := protocol.ReadMessageHeader(br, version, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.DiscardMessage(br, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteAck(bufio.NewWriter(conn), hdr.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	return hdr
+}
+
+func waitProducer(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for producer completion")
+	}
+}
+
+func TestExplicitPartition(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PartitionCount = 8
+	r := New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+
+	// First message names a partition outside partition_count and must be
+	// discarded; the second is routed with its explicit partition.
+	prod := encodeMessages(t, protocol.Version5,
+		protocol.MessageHeader{Key: []byte("bad"), Partition: 8, HasPartition: true},
+		protocol.MessageHeader{Key: []byte("good"), Partition: 5, HasPartition: true},
+	)
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), prod) }()
+
+	hdr := receiveAndAck(t, conn, bufio.NewReader(conn), protocol.Version5)
+	if string(hdr.Key) != "good" || !hdr.HasPartition || hdr.Partition != 5 {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	waitProducer(t, prodDone)
+}
+
+func TestConsumerFilters(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PartitionCount = 8
+	r := New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	byPrefix := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "prefix",
+		Filter: protocol.Filter{KeyPrefix: []byte("img/")}})
+	byHeader := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "header",
+		Filter: protocol.Filter{Headers: []protocol.HeaderField{{Name: "type", Value: "log"}}}})
+	byPartition := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "partition",
+		Filter: protocol.Filter{Partitions: []uint64{7}}})
+
+	prod := encodeMessages(t, protocol.Version5,
+		protocol.MessageHeader{Key: []byte("img/1"), HasPartition: true},
+		protocol.MessageHeader{Key: []byte("x"), HasPartition: true, Headers: []protocol.HeaderField{{Name: "type", Value: "log"}}},
+		protocol.MessageHeader{Key: []byte("y"), Partition: 7, HasPartition: true},
+		// Matches no consumer and is discarded.
+		protocol.MessageHeader{Key: []byte("z"), Partition: 1, HasPartition: true},
+	)
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), prod) }()
+
+	if h := receiveAndAck(t, byPrefix, bufio.NewReader(byPrefix), protocol.Version5); string(h.Key) != "img/1" {
+		t.Fatalf("prefix consumer got %q", h.Key)
+	}
+	h := receiveAndAck(t, byHeader, bufio.NewReader(byHeader), protocol.Version5)
+	if v, _ := h.Header("type"); string(h.Key) != "x" || v != "log" {
+		t.Fatalf("header consumer got %+v", h)
+	}
+	if h := receiveAndAck(t, byPartition, bufio.NewReader(byPartition), protocol.Version5); string(h.Key) != "y" {
+		t.Fatalf("partition consumer got %q", h.Key)
+	}
+	waitProducer(t, prodDone)
+}
+
+func TestWildcardRoomFanOut(t *testing.T) {
+	m := NewRoomManager(DefaultConfig())
+	get := func(room string) *Router {
+		r, err := m.Get(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exact := pipeConsumer(t, ctx, get("builds.linux.amd64"), protocol.Hello{Version: protocol.Version5, Name: "exact"})
+	single := pipeConsumer(t, ctx, get("builds.*.amd64"), protocol.Hello{Version: protocol.Version5, Name: "single"})
+	tail := pipeConsumer(t, ctx, get("builds.>"), protocol.Hello{Version: protocol.Version5, Name: "tail"})
+	// Does not match and must not receive anything.
+	_ = pipeConsumer(t, ctx, get("builds.*.arm64"), protocol.Hello{Version: protocol.Version5, Name: "other"})
+
+	prod := encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k")})
+	producer := get("builds.linux.amd64")
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- producer.HandleProducer(ctx, producerSession(protocol.Version5), prod) }()
+
+	for _, conn := range []net.Conn{exact, single, tail} {
+		if h := receiveAndAck(t, conn, bufio.NewReader(conn), protocol.Version5); string(h.Key) != "k" {
+			t.Fatalf("unexpected key %q", h.Key)
+		}
+	}
+	waitProducer(t, prodDone)
+}
+
+func TestRoomPolicy(t *testing.T) {
+	m := NewRoomManager(DefaultConfig())
+	m.SetPolicy(RoomPolicy{
+		IdleTTL:  time.Minute,
+		MaxRooms: 3,
+		Static:   []string{"fixed", "builds.>"},
+	})
+
+	if _, err := m.Get("random"); !errors.Is(err, ErrUnknownRoom) {
+		t.Fatalf("expected ErrUnknownRoom, got %v", err)
+	}
+	reaped, err := m.Get("builds.linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("builds.arm"); !errors.Is(err, ErrTooManyRooms) {
+		t.Fatalf("expected ErrTooManyRooms, got %v", err)
+	}
+
+	// Only the dynamically created room is reaped once idle.
+	m.reapIdle(time.Now().Add(2 * time.Minute))
+	if _, ok := m.rooms["builds.linux"]; ok {
+		t.Fatal("idle room was not reaped")
+	}
+	if _, ok := m.rooms["fixed"]; !ok {
+		t.Fatal("static room was reaped")
+	}
+	// Clients still holding the reaped room are sent to its successor.
+	if err := reaped.HandleProducer(context.Background(), producerSession(protocol.Version5), encodeMessages(t, protocol.Version5)); !errors.Is(err, ErrRoomClosed) {
+		t.Fatalf("producer on reaped room: got %v, want ErrRoomClosed", err)
+	}
+
+	// Rooms with consumers are kept.
+	r, err := m.Get("builds.x86")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_ = pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+	m.reapIdle(time.Now().Add(2 * time.Minute))
+	if _, ok := m.rooms["builds.x86"]; !ok {
+		t.Fatal("room with a consumer was reaped")
+	}
+}
+
+func TestRoomOverrides(t *testing.T) {
+	base := DefaultConfig()
+	m := NewRoomManager(base)
+	r, err := m.Get("builds.linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.config().PartitionCount; got != base.PartitionCount {
+		t.Fatalf("partition count %d, want base %d", got, base.PartitionCount)
+	}
+
+	// Reload applies to existing rooms; the first matching override wins.
+	m.UpdateConfig(base,
+		RoomOverride{Match: "builds.linux", PartitionCount: 4},
+		RoomOverride{Match: "builds.>", PartitionCount: 16, DeliveryMode: DeliveryFireAndForget},
+	)
+	if cfg := r.config(); cfg.PartitionCount != 4 || cfg.DeliveryMode != DeliveryAck {
+		t.Fatalf("unexpected config after reload: %+v", cfg)
+	}
+	other, err := m.Get("builds.arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := other.config(); cfg.PartitionCount != 16 || cfg.DeliveryMode != DeliveryFireAndForget {
+		t.Fatalf("unexpected config for new room: %+v", cfg)
+	}
+}
+
+func TestFireAndForgetDoesNotWaitForAck(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeliveryMode = DeliveryFireAndForget
+	r := New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+
+	prod := encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k")})
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), prod) }()
+
+	// The producer finishes while the consumer has not read anything yet.
+	waitProducer(t, prodDone)
+	receiveAndAck(t, conn, bufio.NewReader(conn), protocol.Version5)
+}
+
+func TestSnapshots(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PartitionCount = 4
+	r := New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c1, _ := net.Pipe()
+	sess := Session{
+		Hello:      protocol.Hello{Version: protocol.Version5, Role: protocol.RoleConsumer, Name: "worker"},
+		Principal:  "alice",
+		RemoteAddr: "10.0.0.1:1234",
+		Transport:  "quic",
+	}
+	id, err := r.RegisterConsumer(sess, &ctxConn{Conn: c1, ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := r.Consumers()
+	if len(cs) != 1 || cs[0].ID != id || cs[0].Principal != "alice" || cs[0].RemoteAddr != "10.0.0.1:1234" || cs[0].Name != "worker" {
+		t.Fatalf("unexpected consumers: %+v", cs)
+	}
+	for _, p := range r.Partitions() {
+		if p.ConsumerID != id {
+			t.Fatalf("partition %d assigned to %q, want %q", p.Partition, p.ConsumerID, id)
+		}
+	}
+}
+
+func TestPauseResumeAndKick(t *testing.T) {
+	r := New(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+	br := bufio.NewReader(conn)
+
+	if err := r.Pause(PauseReject); err != nil {
+		t.Fatal(err)
+	}
+	prod := encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k")})
+	if err := r.HandleProducer(ctx, producerSession(protocol.Version5), prod); !errors.Is(err, ErrRoomPaused) {
+		t.Fatalf("reject mode: got %v, want ErrRoomPaused", err)
+	}
+
+	if err := r.Pause(PauseBlock); err != nil {
+		t.Fatal(err)
+	}
+	prodDone := make(chan error, 1)
+	go func() {
+		prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k")}))
+	}()
+	select {
+	case err := <-prodDone:
+		t.Fatalf("producer finished while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !r.Resume() {
+		t.Fatal("Resume reported room was not paused")
+	}
+	receiveAndAck(t, conn, br, protocol.Version5)
+	waitProducer(t, prodDone)
+
+	id := r.Consumers()[0].ID
+	if !r.KickConsumer(id) {
+		t.Fatal("KickConsumer did not find consumer")
+	}
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("kicked consumer stream still open")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.Consumers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("kicked consumer was not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDrainClosesIdleProducers(t *testing.T) {
+	rooms := NewRoomManager(DefaultConfig())
+	r, err := rooms.Get("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+
+	// The producer sends one message and then idles with the stream open.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), bufio.NewReader(pr)) }()
+	go func() {
+		msg := encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k")})
+		_, _ = io.Copy(pw, msg)
+	}()
+	receiveAndAck(t, conn, bufio.NewReader(conn), protocol.Version5)
+
+	type frame struct{ typ, val uint64 }
+	goAway := make(chan frame, 1)
+	gr, gw := io.Pipe()
+	go rooms.sendGoAway(gw, protocol.Version5, nil)
+	go func() {
+		typ, val, _ := protocol.ReadFrame(bufio.NewReader(gr))
+		goAway <- frame{typ, val}
+	}()
+
+	rooms.Drain(time.Second)
+	waitProducer(t, prodDone)
+	if f := <-goAway; f.typ != protocol.FrameGoAway || f.val == 0 || f.val > 1000 {
+		t.Fatalf("unexpected GOAWAY frame type=%d remaining=%dms", f.typ, f.val)
+	}
+
+	dctx, dcancel := context.WithTimeout(ctx, 2*time.Second)
+	defer dcancel()
+	if !rooms.WaitDrained(dctx) {
+		t.Fatal("rooms did not drain")
+	}
+}
+
+func TestDropMetrics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxMessageBytes = 4
+	rooms := NewRoomManager(cfg)
+	r, err := rooms.Get("metrics.drops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Counters are global; compare against their values at the start.
+	counter := func(c prometheus.Collector) func() float64 {
+		base := testutil.ToFloat64(c)
+		return func() float64 { return testutil.ToFloat64(c) - base }
+	}
+	noConsumer := counter(metrics.Drops.WithLabelValues("metrics.drops", dropNoConsumer))
+	badPartition := counter(metrics.Drops.WithLabelValues("metrics.drops", dropBadPartition))
+	tooLarge := counter(metrics.Drops.WithLabelValues("metrics.drops", dropTooLarge))
+	messagesIn := counter(metrics.MessagesIn.WithLabelValues("metrics.drops"))
+	messagesOut := counter(metrics.MessagesOut.WithLabelValues("metrics.drops"))
+	bytesOut := counter(metrics.BytesOut.WithLabelValues("metrics.drops"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// No consumer yet.
+	prod := encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k")})
+	if err := r.HandleProducer(ctx, producerSession(protocol.Version5), prod); err != nil {
+		t.Fatal(err)
+	}
+	if got := noConsumer(); got != 1 {
+		t.Fatalf("no_consumer drops = %v, want 1", got)
+	}
+
+	// A partition out of range is not a missing consumer.
+	prod = encodeMessages(t, protocol.Version5, protocol.MessageHeader{Key: []byte("k"), Partition: 1000, HasPartition: true})
+	if err := r.HandleProducer(ctx, producerSession(protocol.Version5), prod); err != nil {
+		t.Fatal(err)
+	}
+	if got := badPartition(); got != 1 {
+		t.Fatalf("bad_partition drops = %v, want 1", got)
+	}
+	if got := noConsumer(); got != 1 {
+		t.Fatalf("no_consumer drops = %v, want 1", got)
+	}
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+	prod = encodeMessages(t, protocol.Version5,
+		protocol.MessageHeader{Key: []byte("k"), DeclaredSize: 5},
+		protocol.MessageHeader{Key: []byte("k")},
+	)
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), prod) }()
+	receiveAndAck(t, conn, bufio.NewReader(conn), protocol.Version5)
+	waitProducer(t, prodDone)
+
+	if got := tooLarge(); got != 1 {
+		t.Fatalf("too_large drops = %v, want 1", got)
+	}
+	if got := messagesIn(); got != 4 {
+		t.Fatalf("messages in = %v, want 4", got)
+	}
+	if got := messagesOut(); got != 1 {
+		t.Fatalf("messages out = %v, want 1", got)
+	}
+	if got := bytesOut(); got != 1 {
+		t.Fatalf("bytes out = %v, want 1", got)
+	}
+
+	// A full backlog drops messages without counting them as unrouted.
+	cfg.ConsumerQueueDepth = 1
+	cfg.DeliveryMode = DeliveryFireAndForget
+	r, err = NewRoomManager(cfg).Get("metrics.backlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noConsumer = counter(metrics.Drops.WithLabelValues("metrics.backlog", dropNoConsumer))
+	backlogFull := counter(metrics.Drops.WithLabelValues("metrics.backlog", dropBacklogFull))
+	// The consumer never reads, so its backlog fills up.
+	pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+	hdrs := make([]protocol.MessageHeader, 4)
+	for i := range hdrs {
+		hdrs[i] = protocol.MessageHeader{Key: []byte("k")}
+	}
+	if err := r.HandleProducer(ctx, producerSession(protocol.Version5), encodeMessages(t, protocol.Version5, hdrs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := backlogFull(); got < 2 {
+		t.Fatalf("backlog_full drops = %v, want at least 2", got)
+	}
+	if got := noConsumer(); got != 0 {
+		t.Fatalf("no_consumer drops = %v, want 0", got)
+	}
+}
+
+func TestConsumerCollectorLimitsSeries(t *testing.T) {
+	rooms := NewRoomManager(DefaultConfig())
+	r, err := rooms.Get("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+	}
+
+	// Two consumers get their own series, the third is folded into _other.
+	if n := testutil.CollectAndCount(rooms.ConsumerCollector(2), "loom_consumer_backlog"); n != 3 {
+		t.Fatalf("backlog series = %d, want 3", n)
+	}
+	if n := testutil.CollectAndCount(rooms.ConsumerCollector(10), "loom_consumer_pending_acks"); n != 3 {
+		t.Fatalf("pending series = %d, want 3", n)
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	}()
+
+	r := New(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	prod := encodeMessages(t, protocol.Version5, protocol.MessageHeader{
+		Key:     []byte("k"),
+		Headers: []protocol.HeaderField{{Name: "traceparent", Value: parent}},
+	})
+	prodDone := make(chan error, 1)
+	go func() { prodDone <- r.HandleProducer(ctx, producerSession(protocol.Version5), prod) }()
+	got := receiveAndAck(t, conn, bufio.NewReader(conn), protocol.Version5)
+	waitProducer(t, prodDone)
+
+	tp2, _ := got.Header("traceparent")
+	if !strings.HasPrefix(tp2, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || tp2 == parent {
+		t.Fatalf("consumer traceparent = %q, want same trace with router span", tp2)
+	}
+
+	// The consumer's await_ack span ends concurrently with the producer.
+	want := []string{"loom.receive", "loom.route", "loom.queue_wait", "loom.write", "loom.await_ack"}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		names := map[string]bool{}
+		for _, s := range exp.GetSpans() {
+			if s.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Fatalf("span %s in trace %s", s.Name, s.SpanContext.TraceID())
+			}
+			names[s.Name] = true
+		}
+		missing := ""
+		for _, n := range want {
+			if !names[n] {
+				missing = n
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing span %s (have %v)", missing, names)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatchTraceContextPropagation(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	}()
+
+	r := New(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeatureBatch})
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each message of the batch carries a trace of its own.
+	parents := []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	var entries []protocol.BatchEntry
+	for _, p := range parents {
+		entries = append(entries, protocol.BatchEntry{
+			Header:  protocol.MessageHeader{Key: []byte("k"), Headers: []protocol.HeaderField{{Name: "traceparent", Value: p}}},
+			Payload: []byte("x"),
+		})
+	}
+	var b bytes.Buffer
+	if err := protocol.WriteBatch(bufio.NewWriter(&b), protocol.Version6, entries); err != nil {
+		t.Fatal(err)
+	}
+	sess := producerSession(protocol.Version6)
+	sess.Hello.Features = protocol.FeatureBatch
+	done := make(chan error, 1)
+	go func() { done <- r.HandleProducer(ctx, sess, bufio.NewReader(&b)) }()
+
+	ft, n, err := protocol.ReadControlFrame(br)
+	if err != nil || ft != protocol.FrameBatch {
+		t.Fatalf("frame = %d, %v; want a batch", ft, err)
+	}
+	got, err := protocol.ReadBatch(br, protocol.Version6, n, 256, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteAck(bufio.NewWriter(conn), got[0].Header.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	waitProducer(t, done)
+
+	receives := map[string]bool{}
+	for _, s := range exp.GetSpans() {
+		if s.Name == "loom.receive" {
+			receives[s.SpanContext.TraceID().String()] = true
+		}
+	}
+	for i, p := range parents {
+		traceID := strings.Split(p, "-")[1]
+		tp, _ := got[i].Header.Header("traceparent")
+		if !strings.HasPrefix(tp, "00-"+traceID+"-") || tp == p {
+			t.Fatalf("entry %d traceparent = %q, want trace %s with a router span", i, tp, traceID)
+		}
+		if !receives[traceID] {
+			t.Fatalf("no loom.receive span in trace %s", traceID)
+		}
+	}
+}
+
+func TestV6ConsumerReceivesServerHello(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NodeID = "node-a"
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c"})
+	br := bufio.NewReader(conn)
+	sh, err := protocol.ReadServerHello(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Version != protocol.Version6 || sh.Features != protocol.FeatureHeaders {
+		t.Fatalf("unexpected server hello: %+v", sh)
+	}
+	if sh.ConsumerID != "c-1" || sh.NodeID != "node-a" || sh.MaxChunkBytes != uint64(cfg.MaxChunkBytes) ||
+		sh.MaxMessageBytes != cfg.MaxMessageBytes || sh.MaxKeyBytes != uint64(cfg.MaxKeyBytes) {
+		t.Fatalf("unexpected session info: %+v", sh)
+	}
+
+	msgs := encodeMessages(t, protocol.Version6, protocol.MessageHeader{Key: []byte("k")})
+	done := make(chan error, 1)
+	go func() { done <- r.HandleProducer(ctx, producerSession(protocol.Version6), msgs) }()
+	if hdr := receiveAndAck(t, conn, br, protocol.Version6); string(hdr.Key) != "k" {
+		t.Fatalf("key = %q", hdr.Key)
+	}
+	waitProducer(t, done)
+}
+
+func TestRejectHTTP(t *testing.T) {
+	cases := []struct {
+		code   protocol.ErrorCode
+		status int
+	}{
+		{protocol.ErrorUnsupportedVersion, http.StatusBadRequest},
+		{protocol.ErrorUnauthorized, http.StatusUnauthorized},
+		{protocol.ErrorForbiddenRoom, http.StatusForbidden},
+		{protocol.ErrorRoomPaused, http.StatusServiceUnavailable},
+		{protocol.ErrorRoomClosed, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		rejectHTTP(rec, tc.code, "nope")
+		if rec.Code != tc.status {
+			t.Fatalf("%s: status = %d, want %d", tc.code, rec.Code, tc.status)
+		}
+		var body rejectBody
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != tc.code.String() || body.Message != "nope" || body.Retryable != tc.code.Retryable() {
+			t.Fatalf("%s: body = %+v", tc.code, body)
+		}
+	}
+
+	if got := errorCode(fmt.Errorf("get room: %w", ErrUnknownRoom)); got != protocol.ErrorForbiddenRoom {
+		t.Fatalf("errorCode(ErrUnknownRoom) = %s", got)
+	}
+	if got := errorCode(ErrRoomClosed); got != protocol.ErrorRoomClosed || !got.Retryable() {
+		t.Fatalf("errorCode(ErrRoomClosed) = %s", got)
+	}
+	if got := decisionCode(auth.Decision{Reason: "invalid token"}); got != protocol.ErrorUnauthorized {
+		t.Fatalf("decisionCode(invalid token) = %s", got)
+	}
+}
+
+func TestProtocolErrorsBlockProducer(t *testing.T) {
+	m := NewRoomManager(DefaultConfig())
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const key = "orders:p:10.0.0.1:5000"
+	for i := 0; i < 20; i++ {
+		m.recordProducerError("orders", key, errors.New("router: consumer went away"), logger)
+	}
+	if m.producerBlocked("orders", key, logger) {
+		t.Fatal("producer blocked for errors that are not protocol errors")
+	}
+	for i := 0; i < 11; i++ {
+		m.recordProducerError("orders", key, errors.New("protocol: invalid varint"), logger)
+	}
+	if !m.producerBlocked("orders", key, logger) {
+		t.Fatal("producer not blocked after repeated protocol errors")
+	}
+}
+
+func TestIdleConsumerIsDisconnected(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 10 * time.Millisecond
+	cfg.IdleTimeout = 50 * time.Millisecond
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeaturePing})
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+
+	// Answering PINGs keeps the consumer connected past the idle timeout.
+	bw := bufio.NewWriter(conn)
+	deadline := time.Now().Add(3 * cfg.IdleTimeout)
+	for time.Now().Before(deadline) {
+		ft, v, err := protocol.ReadControlFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ft != protocol.FramePing {
+			t.Fatalf("frame type = %d, want PING", ft)
+		}
+		if err := protocol.WriteFrame(bw, protocol.FramePong, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.ConsumerCount(); n != 1 {
+		t.Fatalf("consumers = %d while answering PINGs", n)
+	}
+
+	// A consumer that stops answering is closed.
+	go func() { _, _ = io.Copy(io.Discard, br) }()
+	for r.ConsumerCount() != 0 {
+		if time.Now().After(deadline.Add(time.Second)) {
+			t.Fatal("idle consumer was not disconnected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIdleProducerIsClosed(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.IdleTimeout = 50 * time.Millisecond
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sess := producerSession(protocol.Version6)
+	sess.Hello.Features = protocol.FeaturePing
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	done := make(chan error, 1)
+	go func() { done <- r.HandleProducer(ctx, sess, bufio.NewReader(pr)) }()
+
+	// PONGs between messages count as activity.
+	bw := bufio.NewWriter(pw)
+	for i := 0; i < 4; i++ {
+		time.Sleep(cfg.IdleTimeout / 2)
+		if err := protocol.WriteControlFrame(bw, protocol.FramePong, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("producer closed while answering: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errIdle) {
+			t.Fatalf("err = %v, want errIdle", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle producer was not closed")
+	}
+}
+
+func TestProducerAbort(t *testing.T) {
+	r := New(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aborted := metrics.Drops.WithLabelValues("", dropAborted)
+	before := testutil.ToFloat64(aborted)
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeatureAbort})
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first message is aborted after one chunk, the second completes.
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	for i, code := range []uint64{protocol.EndAborted, protocol.EndComplete} {
+		if err := protocol.WriteMessageHeader(w, protocol.Version6, protocol.MessageHeader{Key: []byte{'a' + byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.WriteChunk(w, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.WriteMessageEnd(w, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sess := producerSession(protocol.Version6)
+	sess.Hello.Features = protocol.FeatureAbort
+	done := make(chan error, 1)
+	go func() { done <- r.HandleProducer(ctx, sess, bufio.NewReader(&b)) }()
+
+	readMessage := func() (protocol.MessageHeader, uint64) {
+		t.Helper()
+		hdr, err := protocol.ReadMessageHeader(br, protocol.Version6, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, eom, err := protocol.ReadChunk(br, 64<<10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if eom {
+				break
+			}
+		}
+		code, err := protocol.ReadEndCode(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hdr, code
+	}
+
+	// The aborted message is skipped if it was still queued, or else ends
+	// with the abort marker.
+	hdr, code := readMessage()
+	if string(hdr.Key) == "a" {
+		if code != protocol.EndAborted {
+			t.Fatalf("first message code = %d, want aborted", code)
+		}
+		hdr, code = readMessage()
+	}
+	if string(hdr.Key) != "b" || code != protocol.EndComplete {
+		t.Fatalf("second message key=%q code=%d, want complete b", hdr.Key, code)
+	}
+	if err := protocol.WriteAck(bufio.NewWriter(conn), hdr.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	waitProducer(t, done)
+	if got := testutil.ToFloat64(aborted) - before; got != 1 {
+		t.Fatalf("aborted drops = %v, want 1", got)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UploadDir = t.TempDir()
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version5, Name: "c"})
+	cr := bufio.NewReader(conn)
+
+	sess := producerSession(protocol.Version6)
+	sess.Hello.Features = protocol.FeatureResume
+	// Without auth every producer would share the anonymous principal.
+	sess.Principal = anonymousPrincipal
+	if r.features(sess)&protocol.FeatureResume != 0 {
+		t.Fatal("resume granted to an anonymous producer")
+	}
+	sess.Principal = "alice"
+	// The first stream drops after "hello ".
+	var first bytes.Buffer
+	w := bufio.NewWriter(&first)
+	hdr := protocol.MessageHeader{Key: []byte("k"), DeclaredSize: 11, HasUpload: true, UploadID: 7}
+	if err := protocol.WriteMessageHeader(w, protocol.Version6, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteChunk(w, []byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.HandleProducer(ctx, sess, bufio.NewReader(&first)); !errors.Is(err, io.EOF) {
+		t.Fatalf("interrupted upload: err = %v, want EOF", err)
+	}
+
+	// The second stream asks where the upload stands, finishes it, asks
+	// again, then tries to send it once more.
+	var second bytes.Buffer
+	w = bufio.NewWriter(&second)
+	if err := protocol.WriteControlFrame(w, protocol.FrameUploadQuery, 7); err != nil {
+		t.Fatal(err)
+	}
+	hdr.UploadOffset = 6
+	if err := protocol.WriteMessageHeader(w, protocol.Version6, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteChunk(w, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteEndOfMessage(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteControlFrame(w, protocol.FrameUploadQuery, 7); err != nil {
+		t.Fatal(err)
+	}
+	hdr.UploadOffset = 0
+	if err := protocol.WriteMessageHeader(w, protocol.Version6, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteChunk(w, []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteEndOfMessage(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sess.uploadStatus = make(chan protocol.UploadStatus)
+	done := make(chan error, 1)
+	go func() { done <- r.HandleProducer(ctx, sess, bufio.NewReader(&second)) }()
+
+	status := func(want protocol.UploadStatus) {
+		t.Helper()
+		select {
+		case got := <-sess.uploadStatus:
+			if got != want {
+				t.Fatalf("upload status = %+v, want %+v", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for upload status")
+		}
+	}
+	status(protocol.UploadStatus{ID: 7, Offset: 6, State: protocol.UploadPartial})
+
+	got, err := protocol.ReadMessageHeader(cr, protocol.Version5, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	for {
+		chunk, eom, err := protocol.ReadChunk(cr, 64<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eom {
+			break
+		}
+		body = append(body, chunk...)
+	}
+	if string(got.Key) != "k" || string(body) != "hello world" {
+		t.Fatalf("delivered key=%q body=%q", got.Key, body)
+	}
+	if err := protocol.WriteAck(bufio.NewWriter(conn), got.MsgID); err != nil {
+		t.Fatal(err)
+	}
+
+	status(protocol.UploadStatus{ID: 7, Offset: 11, State: protocol.UploadComplete})
+	status(protocol.UploadStatus{ID: 7, Offset: 11, State: protocol.UploadComplete})
+	waitProducer(t, done)
+}
+
+func TestStagedUploadsExpire(t *testing.T) {
+	s := newUploadStore(t.TempDir(), time.Minute)
+	name := uploadName("room", "p", 1)
+	u, _, err := s.open(name, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	u.suspend()
+
+	if st := s.status(name, 1); st.State != protocol.UploadPartial || st.Offset != 3 {
+		t.Fatalf("status = %+v, want partial at 3", st)
+	}
+	s.reap(time.Now())
+	if st := s.status(name, 1); st.State != protocol.UploadPartial {
+		t.Fatalf("fresh upload reaped: %+v", st)
+	}
+	s.reap(time.Now().Add(2 * time.Minute))
+	if st := s.status(name, 1); st.State != protocol.UploadUnknown || st.Offset != 0 {
+		t.Fatalf("status after TTL = %+v, want unknown", st)
+	}
+
+	// A completed payload outlives the TTL while deliveries reference it.
+	name = uploadName("room", "p", 2)
+	if u, _, err = s.open(name, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	d, err := u.complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reap(time.Now().Add(2 * time.Minute))
+	if _, err := os.Stat(d.path); err != nil {
+		t.Fatalf("referenced payload reaped: %v", err)
+	}
+	d.release()
+	if _, err := os.Stat(d.path); !os.IsNotExist(err) {
+		t.Fatalf("released payload still staged: %v", err)
+	}
+	s.reap(time.Now().Add(2 * time.Minute))
+	if st := s.status(name, 2); st.State != protocol.UploadUnknown {
+		t.Fatalf("status after release and TTL = %+v, want unknown", st)
+	}
+}
+
+func TestUploadStatusAfterControlStops(t *testing.T) {
+	// The control writer has returned, as after a failed write.
+	controlDone := make(chan struct{})
+	close(controlDone)
+	sess := Session{uploadStatus: make(chan protocol.UploadStatus), controlDone: controlDone}
+	if err := sess.sendUploadStatus(context.Background(), protocol.UploadStatus{ID: 1}); !errors.Is(err, errControlClosed) {
+		t.Fatalf("send upload status = %v, want %v", err, errControlClosed)
+	}
+}
+
+func TestConsumerResumesRetainedMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UploadDir = t.TempDir()
+	cfg.UploadTTL = time.Minute
+	cfg.Retention = time.Hour
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	csess := Session{Hello: protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeatureResume}, Principal: "alice"}
+
+	// The first consumer receives the message and disconnects without an ACK.
+	firstCtx, disconnect := context.WithCancel(ctx)
+	first := pipeSession(t, firstCtx, r, csess)
+	br := bufio.NewReader(first)
+	sh, err := protocol.ReadServerHello(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Features&protocol.FeatureResume == 0 {
+		t.Fatalf("resume not granted: %#x", sh.Features)
+	}
+
+	sess := producerSession(protocol.Version6)
+	sess.Hello.Features = protocol.FeatureResume
+	sess.Principal = "alice"
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := protocol.WriteMessageHeader(w, protocol.Version6, protocol.MessageHeader{Key: []byte("k"), HasUpload: true, UploadID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteChunk(w, []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteEndOfMessage(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.HandleProducer(ctx, sess, bufio.NewReader(&b)) }()
+
+	hdr, err := protocol.ReadMessageHeader(br, protocol.Version6, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.DiscardMessage(br, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	disconnect()
+	waitProducer(t, done)
+
+	// The room's retention, not the uploads TTL, sets how long it is kept.
+	r.rmu.Lock()
+	rm := r.retained[hdr.MsgID]
+	r.rmu.Unlock()
+	if rm == nil || time.Until(rm.expires) < 50*time.Minute {
+		t.Fatalf("retained message = %+v, want it kept for an hour", rm)
+	}
+
+	// A second consumer resumes it part way; unknown ids are refused.
+	second := pipeSession(t, ctx, r, csess)
+	br = bufio.NewReader(second)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+	cw := bufio.NewWriter(second)
+	if err := protocol.WriteResume(cw, hdr.MsgID+100, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ft, v, err := protocol.ReadControlFrame(br); err != nil || ft != protocol.FrameNotRetained || v != hdr.MsgID+100 {
+		t.Fatalf("ReadControlFrame = %d, %d, %v; want NOT_RETAINED %d", ft, v, err, hdr.MsgID+100)
+	}
+
+	if err := protocol.WriteResume(cw, hdr.MsgID, 6); err != nil {
+		t.Fatal(err)
+	}
+	got, err := protocol.ReadMessageHeader(br, protocol.Version6, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MsgID != hdr.MsgID || !got.HasOffset || got.Offset != 6 {
+		t.Fatalf("resumed header = %+v", got)
+	}
+	var body []byte
+	for {
+		chunk, eom, err := protocol.ReadChunk(br, 64<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eom {
+			break
+		}
+		body = append(body, chunk...)
+	}
+	if string(body) != "world" {
+		t.Fatalf("resumed body = %q, want %q", body, "world")
+	}
+	if err := protocol.WriteAck(cw, got.MsgID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once ACKed the payload is deleted.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		matches, _ := filepath.Glob(filepath.Join(cfg.UploadDir, "*"+msgSuffix))
+		if len(matches) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("retained payload not deleted: %v", matches)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsumerCreditWindow(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeliveryMode = DeliveryFireAndForget
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeatureCredit})
+	br := bufio.NewReader(conn)
+	cw := bufio.NewWriter(conn)
+	sh, err := protocol.ReadServerHello(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Features&protocol.FeatureCredit == 0 {
+		t.Fatalf("credit not granted: %#x", sh.Features)
+	}
+	// Ten messages, but at most two bytes, awaiting ACK.
+	if err := protocol.WriteCredit(cw, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdrs []protocol.MessageHeader
+	for i := 0; i < 4; i++ {
+		hdrs = append(hdrs, protocol.MessageHeader{Key: []byte{'a' + byte(i)}})
+	}
+	// Fire-and-forget: the producer returns once everything is queued.
+	if err := r.HandleProducer(ctx, producerSession(protocol.Version6), encodeMessages(t, protocol.Version6, hdrs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() protocol.MessageHeader {
+		t.Helper()
+		hdr, err := protocol.ReadMessageHeader(br, protocol.Version6, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.DiscardMessage(br, 64<<10); err != nil {
+			t.Fatal(err)
+		}
+		return hdr
+	}
+	// window waits until the consumer has want messages pending and the
+	// rest still queued.
+	window := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			cs := r.Consumers()
+			if len(cs) == 1 && cs[0].PendingAcks == want && cs[0].Backlog == len(hdrs)-want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("consumers = %+v, want %d pending", cs, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if cs := r.Consumers(); cs[0].PendingAcks != want {
+			t.Fatalf("pending = %d after window filled, want %d", cs[0].PendingAcks, want)
+		}
+	}
+
+	first, _ := read(), read()
+	window(2)
+
+	// A larger message window with no byte bound lets a third through.
+	if err := protocol.WriteCredit(cw, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	window(3)
+
+	// ACKing one makes room for the last.
+	if err := protocol.WriteAck(cw, first.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	if last := read(); string(last.Key) != "d" {
+		t.Fatalf("last key = %q, want d", last.Key)
+	}
+}
+
+func TestCreditWindowReopensWithoutAck(t *testing.T) {
+	r := New(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeatureCredit})
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteCredit(bufio.NewWriter(conn), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Consumers()[0].CreditMessages != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("credit not applied")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	read := make(chan string)
+	go func() {
+		for {
+			hdr, err := protocol.ReadMessageHeader(br, protocol.Version6, 256)
+			if err != nil {
+				return
+			}
+			if err := protocol.DiscardMessage(br, 64<<10); err != nil {
+				return
+			}
+			read <- string(hdr.Key)
+		}
+	}()
+	expect := func(key string) {
+		t.Helper()
+		select {
+		case got := <-read:
+			if got != key {
+				t.Fatalf("key = %q, want %q", got, key)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %q", key)
+		}
+	}
+	produce := func(ctx context.Context, key string) {
+		prod := encodeMessages(t, protocol.Version6, protocol.MessageHeader{Key: []byte(key)})
+		go func() { _ = r.HandleProducer(ctx, producerSession(protocol.Version6), prod) }()
+	}
+
+	// Two messages fill the window; neither is ACKed.
+	actx, acancel := context.WithCancel(ctx)
+	produce(actx, "a")
+	expect("a")
+	produce(ctx, "b")
+	expect("b")
+	produce(ctx, "c")
+	select {
+	case got := <-read:
+		t.Fatalf("%q delivered beyond the window", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The first producer giving up resolves its message without an ACK,
+	// which makes room for the third.
+	acancel()
+	expect("c")
+}
+
+// pipeStreams opens data streams as pipes, handing the consumer's ends to
+// the test.
+type pipeStreams chan net.Conn
+
+func (p pipeStreams) OpenDataStream(ctx context.Context) (dataStream, error) {
+	c1, c2 := net.Pipe()
+	select {
+	case p <- c2:
+		return pipeDataStream{c1}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeDataStream struct{ net.Conn }
+
+func (p pipeDataStream) Cancel() { _ = p.Close() }
+
+func TestConsumerDataStreams(t *testing.T) {
+	r := New(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streams := make(pipeStreams)
+	c1, conn := net.Pipe()
+	defer conn.Close()
+	hello := protocol.Hello{Version: protocol.Version6, Role: protocol.RoleConsumer, Name: "c", Features: protocol.FeatureStreams, DataStreams: 2}
+	id, err := r.RegisterConsumer(Session{Hello: hello, streams: streams}, &ctxConn{Conn: c1, ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	cw := bufio.NewWriter(conn)
+	sh, err := protocol.ReadServerHello(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Features&protocol.FeatureStreams == 0 || sh.DataStreams != 2 {
+		t.Fatalf("server hello = %+v, want two data streams", sh)
+	}
+
+	accept := func() *bufio.Reader {
+		t.Helper()
+		select {
+		case s := <-streams:
+			t.Cleanup(func() { _ = s.Close() })
+			sr := bufio.NewReader(s)
+			got, err := protocol.ReadDataStreamHeader(sr, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != id {
+				t.Fatalf("data stream for %q, want %q", got, id)
+			}
+			return sr
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for a data stream")
+			return nil
+		}
+	}
+
+	// The first producer sends one chunk of a large message and stalls. The
+	// chunk is larger than the write buffer, so it reaches the consumer.
+	chunk := bytes.Repeat([]byte("x"), 8<<10)
+	pr, pw := io.Pipe()
+	bigDone := make(chan error, 1)
+	go func() { bigDone <- r.HandleProducer(ctx, producerSession(protocol.Version6), bufio.NewReader(pr)) }()
+	w := bufio.NewWriter(pw)
+	if err := protocol.WriteMessageHeader(w, protocol.Version6, protocol.MessageHeader{Key: []byte("big")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteChunk(w, chunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	bigStream := accept()
+	big, err := protocol.ReadMessageHeader(bigStream, protocol.Version6, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(big.Key) != "big" {
+		t.Fatalf("first key = %q, want big", big.Key)
+	}
+	if got, _, err := protocol.ReadChunk(bigStream, 64<<10); err != nil || !bytes.Equal(got, chunk) {
+		t.Fatalf("chunk = %d bytes, %v", len(got), err)
+	}
+
+	// A small message is delivered on a second stream meanwhile.
+	smallDone := make(chan error, 1)
+	go func() {
+		smallDone <- r.HandleProducer(ctx, producerSession(protocol.Version6), encodeMessages(t, protocol.Version6, protocol.MessageHeader{Key: []byte("small")}))
+	}()
+	smallStream := accept()
+	small, err := protocol.ReadMessageHeader(smallStream, protocol.Version6, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(small.Key) != "small" {
+		t.Fatalf("second key = %q, want small", small.Key)
+	}
+	if err := protocol.DiscardMessage(smallStream, 64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smallStream.ReadByte(); err != io.EOF {
+		t.Fatalf("small stream not closed after its message: %v", err)
+	}
+	if err := protocol.WriteAck(cw, small.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	waitProducer(t, smallDone)
+
+	// The large message then completes on its own stream.
+	if err := protocol.WriteEndOfMessage(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = pw.Close()
+	if _, done, err := protocol.ReadChunk(bigStream, 64<<10); err != nil || !done {
+		t.Fatalf("end of big message = %v, %v", done, err)
+	}
+	if err := protocol.WriteAck(cw, big.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	waitProducer(t, bigDone)
+}
+
+func TestDataStreamsHonorCredit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeliveryMode = DeliveryFireAndForget
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streams := make(pipeStreams)
+	c1, conn := net.Pipe()
+	defer conn.Close()
+	hello := protocol.Hello{Version: protocol.Version6, Role: protocol.RoleConsumer, Name: "c", Features: protocol.FeatureStreams | protocol.FeatureCredit, DataStreams: 4}
+	id, err := r.RegisterConsumer(Session{Hello: hello, streams: streams}, &ctxConn{Conn: c1, ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	cw := bufio.NewWriter(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.RLock()
+	c := r.consumers[id]
+	r.mu.RUnlock()
+	credit := func(messages uint64) {
+		t.Helper()
+		if err := protocol.WriteCredit(cw, messages, 0); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for c.creditMessages.Load() != messages {
+			if time.Now().After(deadline) {
+				t.Fatalf("credit of %d not applied", messages)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	accept := func() protocol.MessageHeader {
+		t.Helper()
+		select {
+		case s := <-streams:
+			t.Cleanup(func() { _ = s.Close() })
+			sr := bufio.NewReader(s)
+			if _, err := protocol.ReadDataStreamHeader(sr, 64); err != nil {
+				t.Fatal(err)
+			}
+			hdr, err := protocol.ReadMessageHeader(sr, protocol.Version6, 256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := protocol.DiscardMessage(sr, 64); err != nil {
+				t.Fatal(err)
+			}
+			return hdr
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for a data stream")
+			return protocol.MessageHeader{}
+		}
+	}
+	none := func() {
+		t.Helper()
+		select {
+		case <-streams:
+			t.Fatal("data stream opened beyond the window")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// A window of one message holds back the rest despite free streams.
+	credit(1)
+	hdrs := []protocol.MessageHeader{{Key: []byte("a")}, {Key: []byte("b")}, {Key: []byte("c")}}
+	if err := r.HandleProducer(ctx, producerSession(protocol.Version6), encodeMessages(t, protocol.Version6, hdrs...)); err != nil {
+		t.Fatal(err)
+	}
+	first := accept()
+	none()
+
+	// An empty window pauses delivery.
+	credit(0)
+	if err := protocol.WriteAck(cw, first.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	none()
+	credit(1)
+	if second := accept(); string(second.Key) != "b" {
+		t.Fatalf("second key = %q, want b", second.Key)
+	}
+	none()
+}
+
+// datagramPipe carries datagrams in one direction.
+type datagramPipe chan []byte
+
+func (d datagramPipe) SendDatagram(b []byte) error {
+	d <- b
+	return nil
+}
+
+func (d datagramPipe) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-d:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDatagramMessages(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DatagramMaxBytes = 16
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toClient, toServer := make(datagramPipe, 8), make(datagramPipe, 8)
+	dg := newDatagramConn(toClient)
+	go dg.receive(ctx, toServer)
+
+	c1, conn := net.Pipe()
+	defer conn.Close()
+	hello := protocol.Hello{Version: protocol.Version6, Role: protocol.RoleConsumer, Name: "c", Features: protocol.FeatureDatagrams}
+	if _, err := r.RegisterConsumer(Session{Hello: hello, datagrams: dg, streamID: 0}, &ctxConn{Conn: c1, ctx: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	sh, err := protocol.ReadServerHello(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Features&protocol.FeatureDatagrams == 0 || sh.DatagramMaxBytes != 16 {
+		t.Fatalf("server hello = %+v, want datagrams of 16 bytes", sh)
+	}
+
+	// The producer's stream stays open while it sends datagrams.
+	psess := producerSession(protocol.Version6)
+	psess.Hello.Features = protocol.FeatureDatagrams
+	psess.datagrams, psess.streamID = dg, 4
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() { _ = r.HandleProducer(ctx, psess, bufio.NewReader(pr)) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dg.mu.Lock()
+		registered := dg.producers[4] != nil
+		dg.mu.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("producer did not register for datagrams")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tooLarge := metrics.Drops.WithLabelValues("", dropTooLarge)
+	before := testutil.ToFloat64(tooLarge)
+	send := func(key, payload string) {
+		t.Helper()
+		b, err := protocol.AppendDatagram(nil, 4, protocol.Version6, protocol.MessageHeader{Key: []byte(key)}, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		toServer <- b
+	}
+	send("big", "more than sixteen bytes")
+	send("k", "hi")
+
+	select {
+	case b := <-toClient:
+		id, rest, err := protocol.DatagramStreamID(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, payload, err := protocol.ReadDatagramMessage(rest, protocol.Version6, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 0 || string(hdr.Key) != "k" || string(payload) != "hi" {
+			t.Fatalf("datagram for stream %d = %+v, %q", id, hdr, payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for a datagram")
+	}
+	if got := testutil.ToFloat64(tooLarge) - before; got != 1 {
+		t.Fatalf("too_large drops = %v, want 1", got)
+	}
+	// Datagrams are not awaited: the consumer has nothing pending.
+	if cs := r.Consumers(); len(cs) != 1 || cs[0].PendingAcks != 0 {
+		t.Fatalf("consumers = %+v", cs)
+	}
+
+	// A room paused in reject mode counts the datagrams it refuses.
+	paused := metrics.Drops.WithLabelValues("", dropPaused)
+	before = testutil.ToFloat64(paused)
+	if err := r.Pause(PauseReject); err != nil {
+		t.Fatal(err)
+	}
+	send("k", "hi")
+	deadline = time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(paused)-before != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("refused datagram not counted as a paused drop")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// refuseDatagrams fails every datagram sent, as when one is too large for
+// the path.
+type refuseDatagrams struct{}
+
+func (refuseDatagrams) SendDatagram(b []byte) error { return errors.New("datagram too large") }
+
+func TestDatagramFallsBackToStream(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DatagramMaxBytes = 16
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toServer := make(datagramPipe, 8)
+	dg := newDatagramConn(refuseDatagrams{})
+	go dg.receive(ctx, toServer)
+
+	c1, conn := net.Pipe()
+	defer conn.Close()
+	hello := protocol.Hello{Version: protocol.Version6, Role: protocol.RoleConsumer, Name: "c", Features: protocol.FeatureDatagrams}
+	if _, err := r.RegisterConsumer(Session{Hello: hello, datagrams: dg}, &ctxConn{Conn: c1, ctx: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+
+	psess := producerSession(protocol.Version6)
+	psess.Hello.Features = protocol.FeatureDatagrams
+	psess.datagrams, psess.streamID = dg, 4
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() { _ = r.HandleProducer(ctx, psess, bufio.NewReader(pr)) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dg.mu.Lock()
+		registered := dg.producers[4] != nil
+		dg.mu.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("producer did not register for datagrams")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	b, err := protocol.AppendDatagram(nil, 4, protocol.Version6, protocol.MessageHeader{Key: []byte("k")}, []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	toServer <- b
+
+	// The message the datagram could not carry arrives on the stream.
+	hdr, err := protocol.ReadMessageHeader(br, protocol.Version6, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, _, err := protocol.ReadChunk(br, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hdr.Key) != "k" || string(chunk) != "hi" {
+		t.Fatalf("message %+v, %q", hdr, chunk)
+	}
+	if _, eom, err := protocol.ReadChunk(br, 64<<10); err != nil || !eom {
+		t.Fatalf("end of message = %v, %v", eom, err)
+	}
+	if err := protocol.WriteAck(bufio.NewWriter(conn), hdr.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if cs := r.Consumers(); len(cs) == 1 && cs[0].PendingAcks == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("fallback message still pending after its ACK")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDatagramsAreNotAwaited(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DatagramMaxBytes = 16
+	r := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toServer := make(datagramPipe, 8)
+	dg := newDatagramConn(make(datagramPipe, 8))
+	go dg.receive(ctx, toServer)
+
+	// The consumer takes messages on its stream and never ACKs them.
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c"})
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+
+	psess := producerSession(protocol.Version6)
+	psess.Hello.Features = protocol.FeatureDatagrams
+	psess.datagrams, psess.streamID = dg, 4
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() { _ = r.HandleProducer(ctx, psess, bufio.NewReader(pr)) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dg.mu.Lock()
+		registered := dg.producers[4] != nil
+		dg.mu.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("producer did not register for datagrams")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	send := func(key string) {
+		t.Helper()
+		b, err := protocol.AppendDatagram(nil, 4, protocol.Version6, protocol.MessageHeader{Key: []byte(key)}, []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		toServer <- b
+	}
+	send("a")
+	if hdr, err := protocol.ReadMessageHeader(br, protocol.Version6, 256); err != nil || string(hdr.Key) != "a" {
+		t.Fatalf("message %+v, %v", hdr, err)
+	}
+	// "a" is never ACKed, yet "b" is still routed to the backlog.
+	send("b")
+	for {
+		if cs := r.Consumers(); len(cs) == 1 && cs[0].Backlog == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second datagram was not routed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProducerBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	entries := []protocol.BatchEntry{
+		{Header: protocol.MessageHeader{Key: []byte("a")}, Payload: []byte("1")},
+		{Header: protocol.MessageHeader{Key: []byte("b")}, Payload: []byte("22")},
+		{Header: protocol.MessageHeader{Key: []byte("c")}, Payload: []byte("333")},
+	}
+	produce := func(r *Router) <-chan error {
+		var b bytes.Buffer
+		if err := protocol.WriteBatch(bufio.NewWriter(&b), protocol.Version6, entries); err != nil {
+			t.Fatal(err)
+		}
+		sess := producerSession(protocol.Version6)
+		sess.Hello.Features = protocol.FeatureBatch
+		done := make(chan error, 1)
+		go func() { done <- r.HandleProducer(ctx, sess, bufio.NewReader(&b)) }()
+		return done
+	}
+
+	// A batch consumer owning every key gets one BATCH frame and ACKs it once.
+	r := New(DefaultConfig())
+	conn := pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c", Features: protocol.FeatureBatch})
+	br := bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+	done := produce(r)
+	ft, n, err := protocol.ReadControlFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft != protocol.FrameBatch || n != 3 {
+		t.Fatalf("frame = %d, count %d; want a batch of 3", ft, n)
+	}
+	got, err := protocol.ReadBatch(br, protocol.Version6, n, 256, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range got {
+		if string(e.Header.Key) != string(entries[i].Header.Key) || string(e.Payload) != string(entries[i].Payload) {
+			t.Fatalf("entry %d = %+v", i, e)
+		}
+		if e.Header.MsgID != got[0].Header.MsgID {
+			t.Fatalf("entry %d has msg id %d, want the batch's %d", i, e.Header.MsgID, got[0].Header.MsgID)
+		}
+	}
+	if err := protocol.WriteAck(bufio.NewWriter(conn), got[0].Header.MsgID); err != nil {
+		t.Fatal(err)
+	}
+	waitProducer(t, done)
+
+	// A consumer without the feature gets and ACKs each message on its own,
+	// even one larger than a chunk.
+	cfg := DefaultConfig()
+	cfg.MaxChunkBytes = 2
+	r = New(cfg)
+	conn = pipeConsumer(t, ctx, r, protocol.Hello{Version: protocol.Version6, Name: "c"})
+	br = bufio.NewReader(conn)
+	if _, err := protocol.ReadServerHello(br); err != nil {
+		t.Fatal(err)
+	}
+	done = produce(r)
+	for _, e := range entries {
+		if hdr := receiveAndAck(t, conn, br, protocol.Version6); string(hdr.Key) != string(e.Header.Key) {
+			t.Fatalf("key = %q, want %q", hdr.Key, e.Header.Key)
+		}
+	}
+	waitProducer(t, done)
+}
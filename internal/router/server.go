@@ -5,11 +5,13 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"log"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntRouter/Loom/internal/auth"
 	"github.com/BurntRouter/Loom/internal/config"
+	"github.com/BurntRouter/Loom/internal/logging"
 	"github.com/BurntRouter/Loom/internal/metrics"
 	"github.com/BurntRouter/Loom/internal/protocol"
 	quic "github.com/quic-go/quic-go"
@@ -22,6 +24,8 @@ type Server struct {
 
 	Rooms *RoomManager
 	Auth  *AuthContext
+
+	listenState
 }
 
 func (s *Server) ListenAndServe(ctx context.Context) error {
@@ -37,13 +41,17 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 	if quicConf.KeepAlivePeriod == 0 {
 		quicConf.KeepAlivePeriod = 15 * time.Second
 	}
+	// Rooms with datagram_max_bytes set carry small messages as datagrams.
+	quicConf.EnableDatagrams = true
 	listener, err := quic.ListenAddr(s.Addr, tlsConf, quicConf)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
+	s.setListening(true)
+	defer s.setListening(false)
 
-	log.Printf("loom: listening on %s", s.Addr)
+	slog.Info("loom: listening", "addr", s.Addr, logging.KeyTransport, "quic")
 	for {
 		conn, err := listener.Accept(ctx)
 		if err != nil {
@@ -56,13 +64,35 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 
 func (s *Server) handleConn(ctx context.Context, conn *quic.Conn) {
 	defer metrics.Connections.WithLabelValues("quic").Dec()
+	var dg *datagramConn
+	if conn.ConnectionState().SupportsDatagrams {
+		dg = newDatagramConn(conn)
+		go dg.receive(ctx, conn)
+	}
 	for {
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
 			return
 		}
-		go s.handleStream(ctx, conn, stream)
+		go s.handleStream(ctx, conn, dg, stream)
+	}
+}
+
+var errNotListening = errors.New("router: listener not bound")
+
+// listenState records whether a server's listener is up, for health checks.
+type listenState struct {
+	up atomic.Bool
+}
+
+func (l *listenState) setListening(up bool) { l.up.Store(up) }
+
+// Listening returns an error unless the server is accepting connections.
+func (l *listenState) Listening() error {
+	if !l.up.Load() {
+		return errNotListening
 	}
+	return nil
 }
 
 type quicBidiStream struct {
@@ -75,13 +105,39 @@ func (q *quicBidiStream) Write(p []byte) (int, error) { return q.s.Write(p) }
 func (q *quicBidiStream) Close() error                { return q.s.Close() }
 func (q *quicBidiStream) Context() context.Context    { return q.s.Context() }
 
-func (s *Server) handleStream(ctx context.Context, conn *quic.Conn, stream *quic.Stream) {
-	br := bufio.NewReader(stream)
-	role, name, room, token, err := protocol.ReadHello(br, s.Rooms.cfg.MaxNameBytes, s.Rooms.cfg.MaxRoomBytes, s.Rooms.cfg.MaxTokenBytes)
+// quicStreamOpener opens data streams as unidirectional streams on the
+// consumer's connection.
+type quicStreamOpener struct {
+	conn *quic.Conn
+}
+
+func (o quicStreamOpener) OpenDataStream(ctx context.Context) (dataStream, error) {
+	s, err := o.conn.OpenUniStreamSync(ctx)
 	if err != nil {
+		return nil, err
+	}
+	return quicDataStream{s}, nil
+}
+
+type quicDataStream struct {
+	*quic.SendStream
+}
+
+func (q quicDataStream) Cancel() { q.CancelWrite(0) }
+
+func (s *Server) handleStream(ctx context.Context, conn *quic.Conn, dg *datagramConn, stream *quic.Stream) {
+	if s.Rooms.Draining() {
 		_ = stream.Close()
 		return
 	}
+	br := bufio.NewReader(stream)
+	base := s.Rooms.config()
+	hello, err := protocol.ReadHello(br, base.MaxNameBytes, base.MaxRoomBytes, base.MaxTokenBytes)
+	if err != nil {
+		rejectQUIC(stream, hello, errorCode(err), err.Error())
+		return
+	}
+	role, name, room, token := hello.Role, hello.Name, hello.Room, hello.Token
 
 	var roleEnum auth.Role
 	switch role {
@@ -90,7 +146,11 @@ func (s *Server) handleStream(ctx context.Context, conn *quic.Conn, stream *quic
 	case protocol.RoleConsumer:
 		roleEnum = auth.RoleConsume
 	default:
-		_ = stream.Close()
+		rejectQUIC(stream, hello, protocol.ErrorBadHandshake, "unknown role")
+		return
+	}
+	if !validRoom(role, room) {
+		rejectQUIC(stream, hello, protocol.ErrorBadHandshake, "invalid room")
 		return
 	}
 
@@ -99,8 +159,9 @@ func (s *Server) handleStream(ctx context.Context, conn *quic.Conn, stream *quic
 		authCtx = &AuthContext{Mode: config.AuthModeDisabled}
 	}
 	d := authCtx.authorizeQUIC(conn, token, room, roleEnum)
+	recordDecision(d, room, roleEnum, conn.RemoteAddr().String(), "quic")
 	if !d.Allowed {
-		_ = stream.Close()
+		rejectQUIC(stream, hello, decisionCode(d), d.Reason)
 		return
 	}
 
@@ -114,68 +175,62 @@ func (s *Server) handleStream(ctx context.Context, conn *quic.Conn, stream *quic
 	metrics.Streams.WithLabelValues("quic", roleLabel, room).Inc()
 	defer metrics.Streams.WithLabelValues("quic", roleLabel, room).Dec()
 
-	r := s.Rooms.Get(room)
+	sess := Session{Hello: hello, Principal: d.Principal, RemoteAddr: conn.RemoteAddr().String(), Transport: "quic", datagrams: dg, streamID: uint64(stream.StreamID())}
+	logger := sess.logger()
+	r, err := s.Rooms.Get(room)
+	if err != nil {
+		logger.Warn("loom: rejecting stream", logging.KeyErr, err)
+		rejectQUIC(stream, hello, errorCode(err), err.Error())
+		return
+	}
 	switch role {
 	case protocol.RoleConsumer:
 		cs := &quicBidiStream{r: br, s: stream}
-		id, err := r.RegisterConsumer(name, cs)
+		sess.streams = quicStreamOpener{conn}
+		id, err := r.RegisterConsumer(sess, cs)
 		if err != nil {
-			_ = stream.Close()
+			logger.Warn("loom: rejecting consumer", logging.KeyErr, err)
+			rejectQUIC(stream, hello, errorCode(err), err.Error())
 			return
 		}
-		log.Printf("loom: consumer connected room=%q id=%s name=%q", room, id, name)
+		logger.Info("loom: consumer connected", logging.KeyConsumerID, id)
 		select {
 		case <-ctx.Done():
 		case <-stream.Context().Done():
 		}
 	case protocol.RoleProducer:
 		// Check if this producer is blocked due to repeated errors
-		if s.Rooms.errorTracker != nil {
-			producerKey := room + ":" + name + ":" + conn.RemoteAddr().String()
-			if s.Rooms.errorTracker.IsBlocked(producerKey) {
-				log.Printf("loom: rejecting blocked producer room=%q name=%q addr=%s", room, name, conn.RemoteAddr())
-				metrics.BlockedProducers.WithLabelValues(room).Inc()
-				_ = stream.Close()
-				return
-			}
+		producerKey := room + ":" + name + ":" + conn.RemoteAddr().String()
+		if s.Rooms.producerBlocked(room, producerKey, logger) {
+			rejectQUIC(stream, hello, protocol.ErrorBlocked, "too many protocol errors")
+			return
 		}
 
-		if err := r.HandleProducer(ctx, br); err != nil {
+		if err := r.writeServerHello(stream, sess, ""); err != nil {
+			_ = stream.Close()
+			return
+		}
+
+		stop := make(chan struct{})
+		goAwayDone := make(chan struct{})
+		sess.uploadStatus, sess.controlDone = make(chan protocol.UploadStatus), goAwayDone
+		go func() {
+			defer close(goAwayDone)
+			r.runProducerControl(stream, sess, stop)
+		}()
+		err := r.HandleProducer(ctx, sess, br)
+		close(stop)
+		<-goAwayDone
+		if err != nil {
 			if !errors.Is(err, context.Canceled) {
-				remoteAddr := conn.RemoteAddr().String()
-				producerKey := room + ":" + name + ":" + remoteAddr
-
-				// Check if this is a protocol error (likely client bug)
-				errMsg := err.Error()
-				isProtocolError := errors.Is(err, protocol.ErrBadHandshake) ||
-					errMsg == "protocol: empty key - possible stream corruption" ||
-					(len(errMsg) > 9 && errMsg[:9] == "protocol:")
-
-				if isProtocolError {
-					// Categorize error type for metrics
-					errorType := "unknown"
-					if errMsg == "protocol: empty key - possible stream corruption" {
-						errorType = "empty_key"
-					} else if len(errMsg) > 20 && errMsg[:20] == "protocol: chunk too" {
-						errorType = "chunk_too_large"
-					} else if len(errMsg) > 19 && errMsg[:19] == "protocol: key too" {
-						errorType = "key_too_large"
-					} else if len(errMsg) > 25 && errMsg[:25] == "protocol: invalid varint" {
-						errorType = "invalid_varint"
-					}
-					metrics.ProtocolErrors.WithLabelValues(room, errorType).Inc()
-
-					if s.Rooms.errorTracker != nil {
-						if blocked := s.Rooms.errorTracker.RecordError(producerKey); blocked {
-							metrics.BlockedProducers.WithLabelValues(room).Inc()
-							log.Printf("loom: BLOCKED producer due to repeated protocol errors room=%q name=%q addr=%s", room, name, remoteAddr)
-						}
-					}
-				}
-
-				log.Printf("loom: producer stream error room=%q name=%q addr=%s: %v", room, name, remoteAddr, err)
+				s.Rooms.recordProducerError(room, producerKey, err, logger)
+				logger.Warn("loom: producer stream error", logging.KeyErr, err)
 			}
 		}
+		if errors.Is(err, ErrRoomPaused) || errors.Is(err, ErrRoomClosed) {
+			rejectQUIC(stream, hello, errorCode(err), err.Error())
+			return
+		}
 		_ = stream.Close()
 	default:
 		_ = stream.Close()
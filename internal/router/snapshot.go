@@ -0,0 +1,205 @@
+package router
+
+import (
+	"sort"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/subject"
+)
+
+// RoomSummary is a short description of a room for listings.
+type RoomSummary struct {
+	Name      string `json:"name"`
+	Pattern   bool   `json:"pattern"`
+	Paused    string `json:"paused,omitempty"`
+	Consumers int    `json:"consumers"`
+	Producers int    `json:"producers"`
+}
+
+// RoomSnapshot is a point-in-time view of a room.
+type RoomSnapshot struct {
+	Name           string             `json:"name"`
+	Pattern        bool               `json:"pattern"`
+	Paused         string             `json:"paused,omitempty"`
+	PartitionCount int                `json:"partition_count"`
+	DeliveryMode   string             `json:"delivery_mode"`
+	Consumers      []ConsumerSnapshot `json:"consumers"`
+	Producers      []ProducerSnapshot `json:"producers"`
+}
+
+// ConsumerSnapshot is a point-in-time view of a connected consumer.
+type ConsumerSnapshot struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Principal       string    `json:"principal"`
+	Transport       string    `json:"transport"`
+	ProtocolVersion int       `json:"protocol_version"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	Active          bool      `json:"active"`
+	Backlog         int       `json:"backlog"`
+	PendingAcks     int       `json:"pending_acks"`
+	MessagesSent    uint64    `json:"messages_sent"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	// CreditMessages and CreditBytes are the delivery window: how many
+	// messages and bytes may await ACK (0 bytes: unbounded).
+	CreditMessages uint64 `json:"credit_messages"`
+	CreditBytes    uint64 `json:"credit_bytes"`
+}
+
+// ProducerSnapshot is a point-in-time view of a connected producer.
+type ProducerSnapshot struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name"`
+	RemoteAddr       string    `json:"remote_addr"`
+	Principal        string    `json:"principal"`
+	Transport        string    `json:"transport"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	MessagesReceived uint64    `json:"messages_received"`
+	BytesReceived    uint64    `json:"bytes_received"`
+}
+
+// PartitionAssignment names the consumer currently owning a partition. It
+// ignores key-prefix and header filters, which depend on the message.
+type PartitionAssignment struct {
+	Partition  uint64 `json:"partition"`
+	ConsumerID string `json:"consumer_id,omitempty"`
+}
+
+// Rooms lists all rooms sorted by name.
+func (m *RoomManager) Rooms() []RoomSummary {
+	m.mu.RLock()
+	routers := make([]*Router, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		routers = append(routers, r)
+	}
+	m.mu.RUnlock()
+
+	out := make([]RoomSummary, 0, len(routers))
+	for _, r := range routers {
+		r.mu.RLock()
+		out = append(out, RoomSummary{
+			Name:      r.room,
+			Pattern:   subject.IsPattern(r.room),
+			Paused:    r.pauseModeLocked(),
+			Consumers: len(r.consumers),
+			Producers: len(r.producers),
+		})
+		r.mu.RUnlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Lookup returns an existing room without creating it.
+func (m *RoomManager) Lookup(room string) (*Router, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.rooms[room]
+	return r, ok
+}
+
+// ConsumerCount returns the number of connected consumers.
+func (r *Router) ConsumerCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.consumers)
+}
+
+// Snapshot returns a view of the room with its consumers and producers.
+func (r *Router) Snapshot() RoomSnapshot {
+	cfg := r.config()
+	return RoomSnapshot{
+		Name:           r.room,
+		Pattern:        subject.IsPattern(r.room),
+		Paused:         r.PauseMode(),
+		PartitionCount: cfg.PartitionCount,
+		DeliveryMode:   cfg.DeliveryMode,
+		Consumers:      r.Consumers(),
+		Producers:      r.Producers(),
+	}
+}
+
+// Consumers returns the room's consumers ordered by connection time.
+func (r *Router) Consumers() []ConsumerSnapshot {
+	r.mu.RLock()
+	cs := make([]*consumerState, 0, len(r.consumers))
+	for _, c := range r.consumers {
+		cs = append(cs, c)
+	}
+	r.mu.RUnlock()
+
+	out := make([]ConsumerSnapshot, 0, len(cs))
+	for _, c := range cs {
+		c.pmu.Lock()
+		pending := len(c.pending)
+		c.pmu.Unlock()
+		out = append(out, ConsumerSnapshot{
+			ID:              c.id,
+			Name:            c.name,
+			RemoteAddr:      c.session.RemoteAddr,
+			Principal:       c.session.Principal,
+			Transport:       c.session.Transport,
+			ProtocolVersion: int(c.version),
+			ConnectedAt:     c.connectedAt,
+			Active:          c.active.Load(),
+			Backlog:         len(c.send),
+			PendingAcks:     pending,
+			MessagesSent:    c.messagesSent.Load(),
+			BytesSent:       c.bytesSent.Load(),
+			CreditMessages:  c.creditMessages.Load(),
+			CreditBytes:     c.creditBytes.Load(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// Producers returns the room's producers ordered by connection time.
+func (r *Router) Producers() []ProducerSnapshot {
+	r.mu.RLock()
+	out := make([]ProducerSnapshot, 0, len(r.producers))
+	for _, p := range r.producers {
+		out = append(out, ProducerSnapshot{
+			ID:               p.id,
+			Name:             p.session.Hello.Name,
+			RemoteAddr:       p.session.RemoteAddr,
+			Principal:        p.session.Principal,
+			Transport:        p.session.Transport,
+			ConnectedAt:      p.connectedAt,
+			MessagesReceived: p.messages.Load(),
+			BytesReceived:    p.bytes.Load(),
+		})
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// Partitions returns the current partition to consumer assignment.
+func (r *Router) Partitions() []PartitionAssignment {
+	cfg := r.config()
+	r.mu.RLock()
+	cs := make([]*consumerState, 0, len(r.consumers))
+	for _, c := range r.consumers {
+		if c.active.Load() {
+			cs = append(cs, c)
+		}
+	}
+	r.mu.RUnlock()
+
+	out := make([]PartitionAssignment, cfg.PartitionCount)
+	ids := make([]string, 0, len(cs))
+	for i := range out {
+		part := uint64(i)
+		ids = ids[:0]
+		for _, c := range cs {
+			if c.filter.admitsPartition(part) {
+				ids = append(ids, c.id)
+			}
+		}
+		out[i].Partition = part
+		out[i].ConsumerID, _ = r.rh.Pick(partitionKey(part), ids)
+	}
+	return out
+}
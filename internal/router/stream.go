@@ -1,8 +1,14 @@
 package router
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"io"
+	"log/slog"
+
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/protocol"
 )
 
 type Stream interface {
@@ -11,3 +17,110 @@ type Stream interface {
 	io.Closer
 	Context() context.Context
 }
+
+// Session describes the authenticated client behind a stream.
+type Session struct {
+	Hello      protocol.Hello
+	Principal  string
+	RemoteAddr string
+	Transport  string // "quic" or "h3"
+
+	// uploadStatus carries UPLOAD_STATUS frames from HandleProducer to
+	// runProducerControl, which owns writes to the producer stream.
+	// controlDone is closed once runProducerControl has returned.
+	uploadStatus chan protocol.UploadStatus
+	controlDone  <-chan struct{}
+	// streams opens data streams to a consumer. Nil where the transport
+	// cannot open streams towards the client.
+	streams streamOpener
+	// datagrams carries datagrams on the client's QUIC connection, whose
+	// datagrams name streamID for this session. Nil where the connection
+	// has no datagrams.
+	datagrams *datagramConn
+	streamID  uint64
+}
+
+// errControlClosed is returned when the producer stream can no longer be
+// written to.
+var errControlClosed = errors.New("router: producer stream closed for writing")
+
+// sendUploadStatus queues st for the producer. It is dropped if the
+// session has no control writer, and fails if the writer has stopped.
+func (s Session) sendUploadStatus(ctx context.Context, st protocol.UploadStatus) error {
+	if s.uploadStatus == nil {
+		return nil
+	}
+	select {
+	case s.uploadStatus <- st:
+		return nil
+	case <-s.controlDone:
+		return errControlClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logger returns the default logger annotated with the session's identity.
+func (s Session) logger() *slog.Logger {
+	return slog.Default().With(
+		logging.KeyRoom, s.Hello.Room,
+		logging.KeyName, s.Hello.Name,
+		logging.KeyPrincipal, s.Principal,
+		logging.KeyRemoteAddr, s.RemoteAddr,
+		logging.KeyTransport, s.Transport,
+	)
+}
+
+// authenticated reports whether sess has a principal of its own. Without
+// auth every client shares the anonymous principal.
+func (s Session) authenticated() bool {
+	return s.Principal != "" && s.Principal != anonymousPrincipal
+}
+
+// features returns the features granted to sess on r: resuming uploads and
+// deliveries needs a staging area and an authenticated principal to scope
+// them to, data streams a transport that can open them, and datagrams a
+// connection that carries them into a room that allows them.
+func (r *Router) features(sess Session) uint64 {
+	f := sess.Hello.GrantedFeatures()
+	if r.uploads == nil || !sess.authenticated() {
+		f &^= protocol.FeatureResume
+	}
+	if sess.streams == nil {
+		f &^= protocol.FeatureStreams
+	}
+	if sess.datagrams == nil || r.config().DatagramMaxBytes <= 0 {
+		f &^= protocol.FeatureDatagrams
+	}
+	return f
+}
+
+// serverHello is the answer to the session's Hello on a stream of r.
+// consumerID is empty for producers.
+func (r *Router) serverHello(sess Session, consumerID string) protocol.ServerHello {
+	cfg := r.config()
+	sh := protocol.ServerHello{
+		Version:         sess.Hello.Version,
+		Features:        r.features(sess),
+		MaxChunkBytes:   uint64(cfg.MaxChunkBytes),
+		MaxMessageBytes: cfg.MaxMessageBytes,
+		MaxKeyBytes:     uint64(cfg.MaxKeyBytes),
+		Principal:       sess.Principal,
+		ConsumerID:      consumerID,
+		NodeID:          cfg.NodeID,
+		DataStreams:     uint64(r.dataStreams(sess)),
+	}
+	if sh.Features&protocol.FeatureDatagrams != 0 {
+		sh.DatagramMaxBytes = uint64(cfg.DatagramMaxBytes)
+	}
+	return sh
+}
+
+// writeServerHello answers a v6+ Hello on w. Older clients expect no answer
+// and get nothing.
+func (r *Router) writeServerHello(w io.Writer, sess Session, consumerID string) error {
+	if sess.Hello.Version < protocol.Version6 {
+		return nil
+	}
+	return protocol.WriteServerHello(bufio.NewWriter(w), r.serverHello(sess, consumerID))
+}
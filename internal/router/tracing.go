@@ -0,0 +1,97 @@
+package router
+
+import (
+	"context"
+
+	"github.com/BurntRouter/Loom/internal/protocol"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/BurntRouter/Loom/internal/router"
+
+// tracer returns a tracer from the current global provider, which is a no-op
+// unless tracing is set up.
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// headerCarrier exposes message headers to the propagation API.
+type headerCarrier struct {
+	headers []protocol.HeaderField
+}
+
+func (c *headerCarrier) Get(key string) string {
+	for _, f := range c.headers {
+		if f.Name == key {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Set replaces an existing field or appends one if there is room.
+func (c *headerCarrier) Set(key, value string) {
+	for i := range c.headers {
+		if c.headers[i].Name == key {
+			c.headers[i].Value = value
+			return
+		}
+	}
+	if len(c.headers) < protocol.MaxHeaderFields {
+		c.headers = append(c.headers, protocol.HeaderField{Name: key, Value: value})
+	}
+}
+
+func (c *headerCarrier) Keys() []string {
+	keys := make([]string, len(c.headers))
+	for i, f := range c.headers {
+		keys[i] = f.Name
+	}
+	return keys
+}
+
+// startReceiveSpan starts the span covering one message from header read to
+// ACK, continuing any trace context the producer sent in the headers. The
+// headers are rewritten to carry the new span so consumers continue the
+// trace from the router.
+func (r *Router) startReceiveSpan(ctx context.Context, hdr *protocol.MessageHeader) (context.Context, trace.Span) {
+	prop := otel.GetTextMapPropagator()
+	in := &headerCarrier{headers: hdr.Headers}
+	ctx, span := tracer().Start(prop.Extract(ctx, in), "loom.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "loom"),
+			attribute.String("messaging.destination.name", r.room),
+			attribute.Int("loom.key_bytes", len(hdr.Key)),
+		))
+	if span.SpanContext().IsValid() {
+		out := &headerCarrier{headers: append([]protocol.HeaderField(nil), hdr.Headers...)}
+		prop.Inject(ctx, out)
+		hdr.Headers = out.headers
+	}
+	return ctx, span
+}
+
+// startConsumerSpan starts a span for msg on consumer c, parented to the
+// message's receive span.
+func startConsumerSpan(msg *routedMessage, c *consumerState, name string, opts ...trace.SpanStartOption) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), msg.spanCtx)
+	opts = append(opts, trace.WithAttributes(
+		attribute.String("loom.consumer", c.id),
+		attribute.Int64("loom.msg_id", int64(msg.msgID)),
+	))
+	_, span := tracer().Start(ctx, name, opts...)
+	return span
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,315 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntRouter/Loom/internal/logging"
+	"github.com/BurntRouter/Loom/internal/protocol"
+)
+
+// errUploadBusy refuses a second stream writing to an upload that is still
+// being written.
+var errUploadBusy = errors.New("router: upload in progress on another stream")
+
+// Staged upload files: name + partSuffix holds the bytes received so far;
+// name + doneSuffix records the size of an upload that completed, and
+// name + msgSuffix holds its payload while deliveries may still need it.
+const (
+	partSuffix = ".part"
+	doneSuffix = ".done"
+	msgSuffix  = ".msg"
+)
+
+// uploadStore is the on-disk staging area for resumable uploads. Uploads are
+// keyed by room, principal and the producer's upload id, so producers cannot
+// see or continue each other's uploads; only authenticated sessions may
+// stage them, since without auth every producer is the same principal.
+type uploadStore struct {
+	dir string
+	ttl time.Duration
+
+	mu     sync.Mutex
+	active map[string]bool // names with a stream writing to them
+	live   map[string]bool // names whose payload deliveries still reference
+}
+
+func newUploadStore(dir string, ttl time.Duration) *uploadStore {
+	if dir == "" {
+		return nil
+	}
+	return &uploadStore{dir: dir, ttl: ttl, active: make(map[string]bool), live: make(map[string]bool)}
+}
+
+// uploadName returns the file name staging an upload.
+func uploadName(room, principal string, id uint64) string {
+	h := sha256.New()
+	h.Write([]byte(room))
+	h.Write([]byte{0})
+	h.Write([]byte(principal))
+	h.Write([]byte{0})
+	h.Write(binary.AppendUvarint(nil, id))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// status reports what is staged under name.
+func (s *uploadStore) status(name string, id uint64) protocol.UploadStatus {
+	st := protocol.UploadStatus{ID: id}
+	if b, err := os.ReadFile(filepath.Join(s.dir, name+doneSuffix)); err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			st.Offset, st.State = n, protocol.UploadComplete
+			return st
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(s.dir, name+partSuffix)); err == nil {
+		st.Offset, st.State = uint64(fi.Size()), protocol.UploadPartial
+	}
+	return st
+}
+
+// open claims the upload for writing from offset, which must match the
+// bytes already staged. On a mismatch it returns a nil upload and the
+// current status.
+func (s *uploadStore) open(name string, id, offset uint64) (*stagedUpload, protocol.UploadStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status(name, id)
+	if s.active[name] {
+		return nil, st, errUploadBusy
+	}
+	if st.State == protocol.UploadComplete || st.Offset != offset {
+		return nil, st, nil
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, st, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, name+partSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, st, err
+	}
+	s.active[name] = true
+	return &stagedUpload{s: s, name: name, f: f, size: offset}, st, nil
+}
+
+func (s *uploadStore) release(name string) {
+	s.mu.Lock()
+	delete(s.active, name)
+	s.mu.Unlock()
+}
+
+// reap deletes staged files not written for longer than the TTL. Payloads
+// still referenced are left to their diskMessage.
+func (s *uploadStore) reap(now time.Time) {
+	if s == nil || s.ttl <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if ext != partSuffix && ext != doneSuffix && ext != msgSuffix {
+			continue
+		}
+		if name := strings.TrimSuffix(e.Name(), ext); s.active[name] || s.live[name] {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || now.Sub(fi.ModTime()) < s.ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, e.Name())); err == nil {
+			slog.Debug("loom: staged upload expired", "file", e.Name())
+		}
+	}
+}
+
+// stagedUpload is an upload claimed by one producer stream.
+type stagedUpload struct {
+	s    *uploadStore
+	name string
+	f    *os.File
+	size uint64
+}
+
+func (u *stagedUpload) write(chunk []byte) error {
+	n, err := u.f.Write(chunk)
+	u.size += uint64(n)
+	return err
+}
+
+// suspend keeps the bytes staged so far for a later stream to continue.
+func (u *stagedUpload) suspend() {
+	_ = u.f.Sync()
+	_ = u.f.Close()
+	u.s.release(u.name)
+}
+
+// remove deletes the upload.
+func (u *stagedUpload) remove() {
+	_ = u.f.Close()
+	_ = os.Remove(u.f.Name())
+	u.s.release(u.name)
+}
+
+// complete records that the upload finished, so a producer that missed the
+// outcome does not send it again, and moves its payload aside for routing.
+func (u *stagedUpload) complete() (*diskMessage, error) {
+	done := filepath.Join(u.s.dir, u.name+doneSuffix)
+	if err := os.WriteFile(done, []byte(strconv.FormatUint(u.size, 10)), 0o600); err != nil {
+		slog.Warn("loom: recording completed upload failed", logging.KeyErr, err)
+	}
+	defer u.s.release(u.name)
+	if err := u.f.Close(); err != nil {
+		_ = os.Remove(u.f.Name())
+		return nil, err
+	}
+	path := filepath.Join(u.s.dir, u.name+msgSuffix)
+	if err := os.Rename(u.f.Name(), path); err != nil {
+		_ = os.Remove(u.f.Name())
+		return nil, err
+	}
+	u.s.mu.Lock()
+	u.s.live[u.name] = true
+	u.s.mu.Unlock()
+	return newDiskMessage(path, u.size, func() {
+		u.s.mu.Lock()
+		delete(u.s.live, u.name)
+		u.s.mu.Unlock()
+	}), nil
+}
+
+// framedReader encodes the bytes of r as a chunk sequence, as a producer
+// would have sent them, followed by an end code if endCode is set.
+type framedReader struct {
+	r       io.Reader
+	chunk   []byte
+	buf     []byte
+	endCode bool
+	eof     bool
+}
+
+func (f *framedReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.eof {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(f.r, f.chunk)
+		if n > 0 {
+			f.buf = binary.AppendUvarint(f.buf[:0], uint64(n))
+			f.buf = append(f.buf, f.chunk[:n]...)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			f.eof = true
+			f.buf = append(f.buf, 0)
+			if f.endCode {
+				f.buf = append(f.buf, byte(protocol.EndComplete))
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// stageUpload receives a message sent as part of a resumable upload. Its
+// chunks are appended to the staging area; once the producer ends the
+// message it is routed from disk like any other. A stream that fails part
+// way leaves the bytes staged for the producer to continue.
+func (r *Router) stageUpload(ctx context.Context, br *bufio.Reader, cfg Config, p *producerState, hdr protocol.MessageHeader) error {
+	if !p.resumes {
+		return errors.New("protocol: upload without the resume feature")
+	}
+	if hdr.DeclaredSize > cfg.MaxMessageBytes {
+		r.recordDrop(dropTooLarge)
+		return discardMessage(br, cfg, p)
+	}
+	name := uploadName(r.room, p.session.Principal, hdr.UploadID)
+	u, st, err := r.uploads.open(name, hdr.UploadID, hdr.UploadOffset)
+	if err != nil && !errors.Is(err, errUploadBusy) {
+		return fmt.Errorf("router: staging upload: %w", err)
+	}
+	if u == nil {
+		// Wrong offset, already complete, or busy: skip the chunks and tell
+		// the producer where the upload stands.
+		if err := discardMessage(br, cfg, p); err != nil {
+			return err
+		}
+		return p.session.sendUploadStatus(ctx, st)
+	}
+
+	for {
+		chunk, done, err := protocol.ReadChunk(br, cfg.MaxChunkBytes)
+		if err != nil {
+			u.suspend()
+			return err
+		}
+		if done {
+			break
+		}
+		if u.size+uint64(len(chunk)) > cfg.MaxMessageBytes {
+			r.recordDrop(dropTooLarge)
+			u.remove()
+			return discardMessage(br, cfg, p)
+		}
+		if err := u.write(chunk); err != nil {
+			u.suspend()
+			return fmt.Errorf("router: staging upload: %w", err)
+		}
+	}
+	if p.aborts {
+		code, err := protocol.ReadEndCode(br)
+		if err != nil {
+			u.suspend()
+			return err
+		}
+		if code == protocol.EndAborted {
+			r.recordDrop(dropAborted)
+			u.remove()
+			return nil
+		}
+	}
+
+	// The whole message is staged: from here it is routed like any other,
+	// except that its deliveries can be resumed from disk.
+	disk, err := u.complete()
+	if err != nil {
+		return fmt.Errorf("router: staging upload: %w", err)
+	}
+	defer disk.release()
+	f, err := os.Open(disk.path)
+	if err != nil {
+		return fmt.Errorf("router: reading staged upload: %w", err)
+	}
+	defer f.Close()
+	body := bufio.NewReader(&framedReader{r: f, chunk: make([]byte, cfg.MaxChunkBytes), endCode: p.aborts})
+	hdr.HasUpload, hdr.UploadID, hdr.UploadOffset = false, 0, 0
+	return r.routeMessage(ctx, body, cfg, p, hdr, origin{disk: disk})
+}
+
+// queryUpload answers a producer's FrameUploadQuery.
+func (r *Router) queryUpload(ctx context.Context, p *producerState, id uint64) error {
+	if !p.resumes {
+		return errors.New("protocol: upload query without the resume feature")
+	}
+	st := r.uploads.status(uploadName(r.room, p.session.Principal, id), id)
+	return p.session.sendUploadStatus(ctx, st)
+}
@@ -0,0 +1,69 @@
+// Package subject implements dotted room names with NATS-style wildcards.
+//
+// A room name is a sequence of tokens separated by '.', e.g. "builds.linux.amd64".
+// In a pattern, the token "*" matches exactly one token and the token ">"
+// matches one or more trailing tokens and must come last.
+package subject
+
+import "strings"
+
+const (
+	sep    = "."
+	single = "*"
+	tail   = ">"
+)
+
+// IsPattern reports whether name contains a wildcard token.
+func IsPattern(name string) bool {
+	for _, t := range strings.Split(name, sep) {
+		if t == single || t == tail {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPattern reports whether name is a well-formed pattern: no empty tokens
+// and ">" only as the last token. Literal names are always valid.
+func ValidPattern(name string) bool {
+	if !IsPattern(name) {
+		return true
+	}
+	toks := strings.Split(name, sep)
+	for i, t := range toks {
+		if t == "" || (t == tail && i != len(toks)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether pattern matches name. Wildcard tokens in name are
+// compared literally against pattern tokens, except that a "*" or ">" in the
+// pattern also matches them, so Match can be used to check that one pattern
+// covers another.
+func Match(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	pt := strings.Split(pattern, sep)
+	nt := strings.Split(name, sep)
+	for i, p := range pt {
+		if p == tail {
+			return i == len(pt)-1 && len(nt) > i
+		}
+		if i >= len(nt) {
+			return false
+		}
+		if p == single {
+			if nt[i] == tail {
+				return false
+			}
+			continue
+		}
+		if p != nt[i] {
+			return false
+		}
+	}
+	return len(pt) == len(nt)
+}
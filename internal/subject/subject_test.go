@@ -0,0 +1,43 @@
+package subject
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"builds.linux.amd64", "builds.linux.amd64", true},
+		{"builds.*.amd64", "builds.linux.amd64", true},
+		{"builds.*.amd64", "builds.linux.arm64", false},
+		{"builds.*", "builds.linux.amd64", false},
+		{"builds.>", "builds.linux.amd64", true},
+		{"builds.>", "builds", false},
+		{">", "builds", true},
+		{"builds.linux", "builds.linux.amd64", false},
+		// Pattern coverage.
+		{"builds.>", "builds.*.amd64", true},
+		{"builds.*.amd64", "builds.>", false},
+		{"builds.linux.amd64", "builds.*.amd64", false},
+	}
+	for _, c := range cases {
+		if got := Match(c.pattern, c.name); got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for name, want := range map[string]bool{
+		"builds":         true,
+		"builds.*.amd64": true,
+		"builds.>":       true,
+		"builds.>.amd64": false,
+		"builds..*":      false,
+		"a.b*":           true, // literal, not a wildcard token
+	} {
+		if got := ValidPattern(name); got != want {
+			t.Errorf("ValidPattern(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
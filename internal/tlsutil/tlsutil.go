@@ -7,6 +7,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"time"
@@ -77,3 +79,30 @@ func generateSelfSignedCert() (tls.Certificate, error) {
 
 	return tls.X509KeyPair(certPEM, keyPEM)
 }
+
+// CheckCertificates returns an error if a certificate in cfg is expired or
+// not yet valid at now.
+func CheckCertificates(cfg *tls.Config, now time.Time) error {
+	if cfg == nil || len(cfg.Certificates) == 0 {
+		return errors.New("tlsutil: no server certificate")
+	}
+	for _, cert := range cfg.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) == 0 {
+				return errors.New("tlsutil: empty certificate chain")
+			}
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		if now.Before(leaf.NotBefore) {
+			return fmt.Errorf("tlsutil: certificate %q not valid until %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339))
+		}
+		if now.After(leaf.NotAfter) {
+			return fmt.Errorf("tlsutil: certificate %q expired at %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}